@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	db "remindal/internal/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Prefix of the API keys, telling them apart from session tokens
+const API_KEY_PREFIX = "rmd_"
+
+// Key of the query parameter selecting an API key by its prefix
+const PREFIX_KEY = "prefix"
+
+// Length of the prefix of the keys stored in clear, to tell them apart
+const API_KEY_PREFIX_LEN = len(API_KEY_PREFIX) + 8
+
+// How often the last use of an API key is recorded, so that scripts sending many
+// requests do not write to the database on each of them
+const API_KEY_USE_PRECISION = time.Minute
+
+var (
+	errExpiryInPast     = errors.New("the expiration time must be in the future")
+	errNoPrefixProvided = errors.New("no API key prefix provided")
+)
+
+// Resolves the API key to the user it belongs to and the scopes it was granted.
+// Returns [errInvalidToken] if the key does not exist, expired, or its user is gone.
+func authenticateAPIKey(ctx context.Context, key string) (*Principal, error) {
+	var k APIKey
+	err := db.GetOne(ctx, db.APIKEY_COLLECTION, "_id", hashToken(key), &k)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, errInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	// expired keys are removed by the database in the background, not right away
+	if k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt) {
+		return nil, errInvalidToken
+	}
+
+	p, err := principalFor(ctx, k.User)
+	if err != nil {
+		return nil, err
+	}
+	p.Scopes = k.Scopes
+	p.apiKey = k.ID
+	touchAPIKey(ctx, k.ID)
+	return p, nil
+}
+
+// Records the last use of the API key, unless it was recorded recently
+func touchAPIKey(ctx context.Context, id string) {
+	now := time.Now().UTC()
+	query := bson.D{
+		{Key: "_id", Value: id},
+		{Key: "lastUsedAt", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$gte", Value: now.Add(-API_KEY_USE_PRECISION)}}}}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "lastUsedAt", Value: now}}}}
+	err := db.UpdateOneMatching(ctx, db.APIKEY_COLLECTION, query, update)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		slog.Error("touchAPIKey - db.UpdateOneMatching", "err", err)
+	}
+}
+
+// Handles requests to create an API key for the logged in user.
+//
+// Reads the name, the scopes and the optional expiration time of the key from the
+// request body, stores the hash of a new key and writes the key as a JSON response.
+// The key is only shown this once. If an error occurs, it responds with the
+// appropriate error message and status code.
+func PutAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger(r).Error("PutAPIKeyHandler - io.ReadAll", "err", err)
+		Eres(w, Err500(err))
+		return
+	}
+
+	var k APIKey
+	if err := json.Unmarshal(body, &k); err != nil {
+		Eres(w, Err400(err))
+		return
+	}
+	if err := validate.Struct(k); err != nil {
+		Eres(w, Err400(localize(err, r)))
+		return
+	}
+	now := time.Now().UTC()
+	if k.ExpiresAt != nil && !k.ExpiresAt.After(now) {
+		Eres(w, Err400(errExpiryInPast))
+		return
+	}
+
+	key, err := newToken()
+	if err != nil {
+		logger(r).Error("PutAPIKeyHandler - newToken", "err", err)
+		Eres(w, Err500(err))
+		return
+	}
+	key = API_KEY_PREFIX + key
+	k.ID = hashToken(key)
+	k.Prefix = key[:API_KEY_PREFIX_LEN]
+	k.User = principalOf(r).Email
+	k.CreatedAt = now
+	k.LastUsedAt = nil
+	if err := db.PutOne(r.Context(), db.APIKEY_COLLECTION, k); err != nil {
+		logger(r).Error("PutAPIKeyHandler - db.PutOne", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	k.Key = key
+	Okres(w, k)
+}
+
+// Handles requests to list the API keys of the logged in user.
+//
+// Retrieves the keys of the user, newest first, and writes them as a JSON response.
+// The keys themselves are never shown again, only their prefixes. If an error occurs,
+// it responds with the appropriate error message and status code.
+func GetAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys := []APIKey{}
+	query := bson.D{{Key: "user", Value: principalOf(r).Email}}
+	err := db.GetMany(r.Context(), db.APIKEY_COLLECTION, query, db.CreateSort("createdAt", -1), &keys)
+	if err != nil {
+		logger(r).Error("GetAPIKeysHandler - db.GetMany", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	Okres(w, keys)
+}
+
+// Handles requests to revoke an API key of the logged in user.
+//
+// Retrieves the prefix of the key from the query parameters and deletes the key.
+// Requests made with it are rejected right away. If an error occurs, it responds
+// with the appropriate error message and status code.
+func DelAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get(PREFIX_KEY)
+	if prefix == "" {
+		Eres(w, Err400(errNoPrefixProvided))
+		return
+	}
+
+	query := bson.D{{Key: "prefix", Value: prefix}, {Key: "user", Value: principalOf(r).Email}}
+	if err := db.DeleteOneMatching(r.Context(), db.APIKEY_COLLECTION, query); err != nil {
+		logger(r).Error("DelAPIKeyHandler - db.DeleteOneMatching", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	Okres(w, nil)
+}
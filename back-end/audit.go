@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	db "remindal/internal/database"
+	"remindal/internal/logging"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Actions recorded in the audit trail
+const (
+	AUDIT_DELETION_SCHEDULED = "deletion_scheduled"
+	AUDIT_DELETION_CANCELED  = "deletion_canceled"
+	AUDIT_ACCOUNT_PURGED     = "account_purged"
+)
+
+// Actors of the actions that were not taken by someone on another user
+const (
+	AUDIT_SELF   = "self"
+	AUDIT_SYSTEM = "system"
+)
+
+// Returns the key the audit trail of the user is stored by
+func auditKey(email string) string {
+	return hashToken(strings.ToLower(email))
+}
+
+// Returns the actor of an action on the user taken by the principal
+func auditActor(p *Principal, email string) string {
+	if p == nil {
+		return AUDIT_SYSTEM
+	}
+	if strings.EqualFold(p.Email, email) {
+		return AUDIT_SELF
+	}
+	return p.Email
+}
+
+// Records the action on the user in the audit trail. Failures are only logged, the
+// action already happened.
+func audit(ctx context.Context, action, email, actor string, details map[string]any) {
+	e := AuditEntry{
+		User:    auditKey(email),
+		Action:  action,
+		Actor:   actor,
+		At:      time.Now().UTC(),
+		Details: details,
+	}
+	if err := db.PutOne(ctx, db.AUDIT_COLLECTION, e); err != nil {
+		logging.FromContext(ctx).Error("audit - db.PutOne", "err", err, "action", action)
+	}
+}
+
+// Handles requests of admins to retrieve the audit trail of a user.
+//
+// Retrieves the email from the query parameters and writes the actions recorded about
+// that user, newest first, as a JSON response. The trail is kept after the user is
+// deleted. If an error occurs, it responds with the appropriate error message and
+// status code.
+func GetAuditHandler(w http.ResponseWriter, r *http.Request) {
+	userEmail := normalizeEmail(r.URL.Query().Get(EMAIL_KEY))
+	if userEmail == "" {
+		Eres(w, Err400(errNoEmailProvided))
+		return
+	}
+
+	entries := []AuditEntry{}
+	query := bson.D{{Key: "user", Value: auditKey(userEmail)}}
+	if err := db.GetMany(r.Context(), db.AUDIT_COLLECTION, query, db.CreateSort("at", -1), &entries); err != nil {
+		logger(r).Error("GetAuditHandler - db.GetMany", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	Okres(w, entries)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	db "remindal/internal/database"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	ROLE_USER  = "user"
+	ROLE_ADMIN = "admin"
+)
+
+const AUTH_SCHEME = "Bearer"
+
+// Scopes an API key can be limited to
+const (
+	SCOPE_DATES_READ   = "dates:read"
+	SCOPE_DATES_WRITE  = "dates:write"
+	SCOPE_USERS_MANAGE = "users:manage"
+)
+
+var (
+	sessionTTL time.Duration
+	admins     string
+)
+
+var (
+	errUnauthenticated = errors.New("authentication required")
+	errInvalidToken    = errors.New("invalid or expired token")
+	errForbidden       = errors.New("not allowed to access this resource")
+	errMissingScope    = errors.New("the API key lacks the scope required by this resource")
+)
+
+// Who a request is made by
+type Principal struct {
+	Email    string
+	Role     string
+	Verified bool
+	// scopes of the API key the request was authenticated with, nil for sessions,
+	// which are not limited
+	Scopes []string
+	// hash of the token of the session the request was authenticated with
+	session string
+	// hash of the API key the request was authenticated with
+	apiKey string
+}
+
+// Reports whether the principal was granted the scope
+func (p *Principal) HasScope(scope string) bool {
+	return p.apiKey == "" || slices.Contains(p.Scopes, scope)
+}
+
+func (p *Principal) IsAdmin() bool {
+	return p != nil && p.Role == ROLE_ADMIN
+}
+
+// Who can access a route
+type permission int
+
+const (
+	// anyone, authenticated or not
+	permPublic permission = iota
+	// any authenticated user
+	permUser
+	// any authenticated user who verified the email
+	permVerified
+	// the user named by the _id query parameter, or an admin
+	permSelf
+	// admins only
+	permAdmin
+)
+
+// Permission of each route by method and path template. Routes missing from the
+// table are restricted to admins.
+var routePermissions = map[string]permission{
+	"GET /healthz": permPublic,
+	"GET /readyz":  permPublic,
+
+	"POST /user/post":            permPublic,
+	"POST /user/login":           permPublic,
+	"POST /user/logout":          permUser,
+	"GET /user/verify":           permPublic,
+	"POST /user/verify/resend":   permPublic,
+	"POST /user/password/forgot": permPublic,
+	"POST /user/password/reset":  permPublic,
+	"POST /user/password/change": permUser,
+	"POST /user/2fa/setup":       permUser,
+	"POST /user/2fa/confirm":     permUser,
+	"POST /user/2fa/disable":     permUser,
+	"POST /user/2fa/reset":       permAdmin,
+	"GET /user/me":               permUser,
+	"POST /user/me":              permUser,
+	"GET /user/me/avatar":        permUser,
+	"POST /user/me/avatar":       permUser,
+	"DELETE /user/me/avatar":     permUser,
+	"GET /user/export":           permUser,
+	"POST /user/export":          permUser,
+	"GET /user/export/download":  permPublic,
+	"GET /user/oidc/login":       permPublic,
+	"GET /user/oidc/callback":    permPublic,
+	"POST /user/oidc/link":       permPublic,
+	"GET /user/apikeys":          permUser,
+	"POST /user/apikeys":         permUser,
+	"DELETE /user/apikeys":       permUser,
+	"GET /user/":                 permSelf,
+	"DELETE /user/del":           permSelf,
+	"GET /user/list":             permAdmin,
+	"POST /user/restore":         permAdmin,
+	"GET /user/audit":            permAdmin,
+
+	"GET /settings/":      permAdmin,
+	"POST /settings/post": permAdmin,
+
+	"GET /date/list":     permUser,
+	"GET /date/stats":    permUser,
+	"GET /date/upcoming": permUser,
+	"POST /date/post":    permVerified,
+	"DELETE /date/del":   permUser,
+	"GET /calendar/month/{year:[0-9]+}/{month:[0-9]+}":            permUser,
+	"GET /calendar/week/{isoYear:[0-9]+}/{week:[0-9]+}":           permUser,
+	"GET /calendar/day/{year:[0-9]+}/{month:[0-9]+}/{day:[0-9]+}": permUser,
+}
+
+// Scope an API key needs to access each route by method and path template. Routes
+// missing from the table can only be accessed with a session, e.g. the ones managing
+// credentials and the API keys themselves.
+var routeScopes = map[string]string{
+	"GET /user/":       SCOPE_USERS_MANAGE,
+	"DELETE /user/del": SCOPE_USERS_MANAGE,
+	"GET /user/list":   SCOPE_USERS_MANAGE,
+	"POST /user/post":  SCOPE_USERS_MANAGE,
+
+	"GET /date/list":     SCOPE_DATES_READ,
+	"GET /date/stats":    SCOPE_DATES_READ,
+	"GET /date/upcoming": SCOPE_DATES_READ,
+	"POST /date/post":    SCOPE_DATES_WRITE,
+	"DELETE /date/del":   SCOPE_DATES_WRITE,
+	"GET /calendar/month/{year:[0-9]+}/{month:[0-9]+}":            SCOPE_DATES_READ,
+	"GET /calendar/week/{isoYear:[0-9]+}/{week:[0-9]+}":           SCOPE_DATES_READ,
+	"GET /calendar/day/{year:[0-9]+}/{month:[0-9]+}/{day:[0-9]+}": SCOPE_DATES_READ,
+}
+
+type principalKey struct{}
+
+// Returns who the request is made by, nil if it is not authenticated
+func principalOf(r *http.Request) *Principal {
+	p, _ := r.Context().Value(principalKey{}).(*Principal)
+	return p
+}
+
+// Returns a new random session token
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Returns the hash a token is stored by
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Creates a session for the user and returns it along with its token
+func newSession(ctx context.Context, email string) (Session, error) {
+	token, err := newToken()
+	if err != nil {
+		return Session{}, err
+	}
+	now := time.Now().UTC()
+	s := Session{
+		ID:        hashToken(token),
+		User:      email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(sessionTTL),
+		Token:     token,
+	}
+	return s, db.PutOne(ctx, db.SESSION_COLLECTION, s)
+}
+
+// Ends every session of the user
+func revokeSessions(ctx context.Context, email string) error {
+	_, err := db.DeleteMany(ctx, db.SESSION_COLLECTION, bson.D{{Key: "user", Value: email}})
+	return err
+}
+
+// Returns the bearer token of the Authorization header, empty if there is none
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, AUTH_SCHEME) {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// Resolves the session or the API key of the token to the user it belongs to. Returns
+// [errInvalidToken] if the session or the key does not exist, expired, or its user is gone.
+func authenticate(ctx context.Context, token string) (*Principal, error) {
+	if strings.HasPrefix(token, API_KEY_PREFIX) {
+		return authenticateAPIKey(ctx, token)
+	}
+
+	var s Session
+	err := db.GetOne(ctx, db.SESSION_COLLECTION, "_id", hashToken(token), &s)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, errInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	// expired sessions are removed by the database in the background, not right away
+	if time.Now().After(s.ExpiresAt) {
+		return nil, errInvalidToken
+	}
+
+	p, err := principalFor(ctx, s.User)
+	if err != nil {
+		return nil, err
+	}
+	p.session = s.ID
+	return p, nil
+}
+
+// Returns the principal of the registered user, [errInvalidToken] if the user is gone
+func principalFor(ctx context.Context, email string) (*Principal, error) {
+	var u User
+	err := db.GetOne(ctx, db.USER_COLLECTION, EMAIL_KEY, email, &u)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, errInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	role := u.Role
+	if role == "" {
+		role = ROLE_USER
+	}
+	return &Principal{Email: u.Email, Role: role, Verified: !u.Unverified}, nil
+}
+
+// Reports whether the principal holds the permission for the request
+func allowed(p *Principal, perm permission, r *http.Request) bool {
+	switch perm {
+	case permPublic:
+		return true
+	case permUser:
+		return p != nil
+	case permVerified:
+		return p != nil && p.Verified
+	case permSelf:
+		account := accountOf(r)
+		return p.IsAdmin() || (p != nil && (account == "" || account == p.Email))
+	}
+	return p.IsAdmin()
+}
+
+// Middleware authenticating the requests carrying a bearer token and checking the
+// permission of the matched route before its handler runs. Requests authenticated with
+// an API key must also hold the scope of the route. Responds with 401 if the
+// route requires authentication and the request lacks a valid token, with 403 if the
+// user is not allowed to access the route.
+func authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		if route == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		perm, ok := routePermissions[r.Method+" "+route]
+		if !ok {
+			perm = permAdmin
+		}
+
+		var p *Principal
+		if token := bearerToken(r); token != "" {
+			var err error
+			p, err = authenticate(r.Context(), token)
+			if errors.Is(err, errInvalidToken) {
+				w.Header().Set("WWW-Authenticate", AUTH_SCHEME)
+				Eres(w, Err401(err))
+				return
+			}
+			if err != nil {
+				logger(r).Error("authorize - authenticate", "err", err)
+				Eres(w, ErrFrom(err))
+				return
+			}
+		}
+
+		if p == nil && perm != permPublic {
+			w.Header().Set("WWW-Authenticate", AUTH_SCHEME)
+			Eres(w, Err401(errUnauthenticated))
+			return
+		}
+		if !allowed(p, perm, r) {
+			err := errForbidden
+			if perm == permVerified {
+				err = errUnverified
+			}
+			Eres(w, Err403(err))
+			return
+		}
+		if p != nil && p.apiKey != "" {
+			scope, ok := routeScopes[r.Method+" "+route]
+			if !ok || !p.HasScope(scope) {
+				Eres(w, Err403(errMissingScope))
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// Gives the admin role to the users listed in the admins flag, retrying until the
+// database can be reached. Emails of users that are not registered are skipped.
+func promoteAdmins(ctx context.Context) {
+	retry(ctx, "promoteAdmins", func(ctx context.Context) error {
+		for _, email := range splitList(admins) {
+			email = normalizeEmail(email)
+			err := db.UpdateOne(ctx, db.USER_COLLECTION, EMAIL_KEY, email, bson.D{{Key: "role", Value: ROLE_ADMIN}})
+			if errors.Is(err, db.ErrNotFound) {
+				slog.Warn("promoteAdmins - user not registered", "user", email)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	for in, want := range map[string]string{
+		"user@example.com":     "user@example.com",
+		"User@Example.COM":     "user@example.com",
+		"  user@example.com\n": "user@example.com",
+	} {
+		if got := normalizeEmail(in); got != want {
+			t.Errorf("normalizeEmail(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestAllowedSelf(t *testing.T) {
+	user := &Principal{Email: "victim@example.com", Role: ROLE_USER}
+	admin := &Principal{Email: "admin@example.com", Role: ROLE_ADMIN}
+	tests := []struct {
+		name    string
+		p       *Principal
+		account string
+		want    bool
+	}{
+		{"own account", user, "victim@example.com", true},
+		{"own account in another case", user, "Victim@Example.com", true},
+		{"no account named", user, "", true},
+		{"another account", user, "other@example.com", false},
+		{"another account differing by case", &Principal{Email: "victim@example.com"}, "VICTIM@example.com.evil", false},
+		{"anonymous", nil, "victim@example.com", false},
+		{"admin", admin, "victim@example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/user"
+			if tt.account != "" {
+				target += "?" + url.Values{EMAIL_KEY: {tt.account}}.Encode()
+			}
+			r := httptest.NewRequest("GET", target, nil)
+			if got := allowed(tt.p, permSelf, r); got != tt.want {
+				t.Fatalf("allowed = %v, want %v", got, tt.want)
+			}
+			// the handler looks the account up by the same email that was allowed
+			if tt.want && tt.p != nil && !tt.p.IsAdmin() && tt.account != "" {
+				if got := normalizeEmail(tt.account); got != tt.p.Email {
+					t.Fatalf("handler looks up %q, principal is %q", got, tt.p.Email)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	db "remindal/internal/database"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Bounds of the years a calendar view can be requested for
+const (
+	MIN_VIEW_YEAR = 1
+	MAX_VIEW_YEAR = 9999
+)
+
+// Converts the path variable k to an integer within the bounds. Adds a [ParamError]
+// to the QueryBuilder if the conversion is unsuccessful or the value is out of bounds.
+func pathInt(vars map[string]string, k string, lo, hi int, b *db.QueryBuilder) int {
+	n, err := strconv.Atoi(vars[k])
+	if err != nil || n < lo || n > hi {
+		b.AddErr(pathBoundsError(k, lo, hi))
+		return lo
+	}
+	return n
+}
+
+// Retrieves the dates matching the query that may occur between start and end
+func datesBetween(ctx context.Context, query bson.D, start, end time.Time) ([]Date, error) {
+	filter := bson.D{{Key: "$and", Value: bson.A{query, occurrenceWindow(start, end)}}}
+	d := []Date{}
+	err := db.GetMany(ctx, db.CALENDAR_COLLECTION, filter, db.CreateSort(YEAR, 1), &d)
+	return d, err
+}
+
+// Handles requests to retrieve the grid of a month.
+//
+// Reads the year and month from the path and the first day of the week from the query
+// parameters, along with the optional type and labels filters. Writes the weeks of the
+// month, including the leading and trailing days of the adjacent months, with the dates
+// placed into each day as a JSON response. If an error occurs, it responds with the
+// appropriate error message and status code.
+func GetMonthViewHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		builder = db.NewQueryBuilder()
+		query   = r.URL.Query()
+		vars    = mux.Vars(r)
+	)
+	year := pathInt(vars, "year", MIN_VIEW_YEAR, MAX_VIEW_YEAR, &builder)
+	month := pathInt(vars, "month", 1, 12, &builder)
+	weekStart, err := parseWeekday(query.Get(WEEK_START))
+	builder.AddErr(err)
+	query.Del(WEEK_START)
+	agendaFilters.build(query, &builder)
+	addOwnerFilter(r, &builder)
+	err = builder.Err()
+	if err != nil {
+		Eres(w, Err400(err))
+		return
+	}
+
+	start, end := monthGridBounds(year, month, weekStart)
+	d, err := datesBetween(r.Context(), builder.Query(), start, end)
+	if err != nil {
+		logger(r).Error("GetMonthViewHandler - datesBetween", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+
+	first := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	days := calendarDays(d, start, end, first, first.AddDate(0, 1, 0), time.Now().UTC())
+	Okres(w, monthView(year, month, weekStart, days))
+}
+
+// Handles requests to retrieve the days of an ISO week, from monday to sunday.
+//
+// Reads the ISO year and week from the path, along with the optional type and labels
+// filters from the query parameters, and writes the days of the week with the dates
+// placed into each of them as a JSON response. If an error occurs, it responds with
+// the appropriate error message and status code.
+func GetWeekViewHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		builder = db.NewQueryBuilder()
+		query   = r.URL.Query()
+		vars    = mux.Vars(r)
+	)
+	isoYear := pathInt(vars, "isoYear", MIN_VIEW_YEAR, MAX_VIEW_YEAR, &builder)
+	week := pathInt(vars, "week", 1, 53, &builder)
+	start, ok := isoWeekStart(isoYear, week)
+	if !ok {
+		reason := fmt.Sprintf("week %d does not exist in %d", week, isoYear)
+		builder.AddErr(&ParamError{Param: "week", Reason: reason})
+	}
+	agendaFilters.build(query, &builder)
+	addOwnerFilter(r, &builder)
+	err := builder.Err()
+	if err != nil {
+		Eres(w, Err400(err))
+		return
+	}
+
+	end := start.AddDate(0, 0, 7)
+	d, err := datesBetween(r.Context(), builder.Query(), start, end)
+	if err != nil {
+		logger(r).Error("GetWeekViewHandler - datesBetween", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+
+	view := WeekView{
+		ISOYear: isoYear,
+		ISOWeek: week,
+		Days:    calendarDays(d, start, end, start, end, time.Now().UTC()),
+	}
+	Okres(w, view)
+}
+
+// Handles requests to retrieve a single day.
+//
+// Reads the year, month and day from the path, along with the optional type and labels
+// filters from the query parameters, and writes the day with its dates as a JSON response.
+// If an error occurs, it responds with the appropriate error message and status code.
+func GetDayViewHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		builder = db.NewQueryBuilder()
+		query   = r.URL.Query()
+		vars    = mux.Vars(r)
+	)
+	year := pathInt(vars, "year", MIN_VIEW_YEAR, MAX_VIEW_YEAR, &builder)
+	month := pathInt(vars, "month", 1, 12, &builder)
+	day := pathInt(vars, "day", 1, 31, &builder)
+	start := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if start.Day() != day {
+		reason := fmt.Sprintf("%d-%02d has less than %d days", year, month, day)
+		builder.AddErr(&ParamError{Param: "day", Reason: reason})
+	}
+	agendaFilters.build(query, &builder)
+	addOwnerFilter(r, &builder)
+	err := builder.Err()
+	if err != nil {
+		Eres(w, Err400(err))
+		return
+	}
+
+	end := start.AddDate(0, 0, 1)
+	d, err := datesBetween(r.Context(), builder.Query(), start, end)
+	if err != nil {
+		logger(r).Error("GetDayViewHandler - datesBetween", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	Okres(w, calendarDays(d, start, end, start, end, time.Now().UTC())[0])
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Key of the query parameter choosing the first day of the week of the month grid
+const WEEK_START = "weekstart"
+
+const DAY_LAYOUT = "2006-01-02"
+
+// Cell of a calendar grid with the dates occurring in that day
+type CalendarDay struct {
+	Date    string `json:"date"`
+	Weekday string `json:"weekday"`
+	ISOWeek int    `json:"isoWeek"`
+	// false for the leading and trailing days of a month grid that belong to the adjacent months
+	InRange bool         `json:"inRange"`
+	Dates   []Occurrence `json:"dates"`
+}
+
+// Row of a calendar grid, numbered after the ISO week of its monday
+type CalendarWeek struct {
+	ISOYear int           `json:"isoYear"`
+	ISOWeek int           `json:"isoWeek"`
+	Days    []CalendarDay `json:"days"`
+}
+
+type MonthView struct {
+	Year      int            `json:"year"`
+	Month     int            `json:"month"`
+	WeekStart string         `json:"weekStart"`
+	Weeks     []CalendarWeek `json:"weeks"`
+}
+
+type WeekView struct {
+	ISOYear int           `json:"isoYear"`
+	ISOWeek int           `json:"isoWeek"`
+	Days    []CalendarDay `json:"days"`
+}
+
+// Parses the name of a weekday, case insensitively. Defaults to monday when empty.
+func parseWeekday(s string) (time.Weekday, error) {
+	if !hasValue(s) {
+		return time.Monday, nil
+	}
+	for wd := time.Sunday; wd <= time.Saturday; wd++ {
+		if strings.EqualFold(wd.String(), s) {
+			return wd, nil
+		}
+	}
+	return 0, &ParamError{Param: WEEK_START, Reason: "must be the english name of a weekday, e.g. monday"}
+}
+
+// Returns the first day of the ISO week of the given ISO year, if the week exists
+func isoWeekStart(isoYear, week int) (time.Time, bool) {
+	// the 4th of January is always in the first ISO week
+	jan4 := time.Date(isoYear, 1, 4, 0, 0, 0, 0, time.UTC)
+	offset := (int(jan4.Weekday()) + 6) % 7
+	start := jan4.AddDate(0, 0, 7*(week-1)-offset)
+	y, w := start.ISOWeek()
+	return start, y == isoYear && w == week
+}
+
+// Computes the occurrences of the date between start, included, and end, excluded.
+// Yearly types occur every year from the stored one onwards, the other dates only once.
+func occurrencesBetween(d Date, start, end, now time.Time) []Occurrence {
+	years := []int{int(d.Year)}
+	if isYearly(d.Type) {
+		years = years[:0]
+		for y := start.Year(); y <= end.Year(); y++ {
+			if y >= int(d.Year) {
+				years = append(years, y)
+			}
+		}
+	}
+
+	occ := []Occurrence{}
+	for _, y := range years {
+		at := dateInYear(d, y)
+		if at.Before(start) || !at.Before(end) {
+			continue
+		}
+		occ = append(occ, Occurrence{
+			Date:     d,
+			At:       at,
+			StartsIn: int64(at.Sub(now) / time.Second),
+			Years:    y - int(d.Year),
+		})
+	}
+	return occ
+}
+
+// Builds the cells of the days between start, included, and end, excluded, placing
+// the occurrences of the dates in them chronologically. Cells outside of the in range
+// interval are marked as such.
+func calendarDays(dates []Date, start, end, inStart, inEnd, now time.Time) []CalendarDay {
+	byDay := map[string][]Occurrence{}
+	for _, d := range dates {
+		for _, o := range occurrencesBetween(d, start, end, now) {
+			k := o.At.Format(DAY_LAYOUT)
+			byDay[k] = append(byDay[k], o)
+		}
+	}
+
+	days := []CalendarDay{}
+	for t := start; t.Before(end); t = t.AddDate(0, 0, 1) {
+		k := t.Format(DAY_LAYOUT)
+		occ := byDay[k]
+		if occ == nil {
+			occ = []Occurrence{}
+		}
+		sort.SliceStable(occ, func(i, j int) bool {
+			return occ[i].At.Before(occ[j].At)
+		})
+		_, week := t.ISOWeek()
+		days = append(days, CalendarDay{
+			Date:    k,
+			Weekday: t.Weekday().String(),
+			ISOWeek: week,
+			InRange: !t.Before(inStart) && t.Before(inEnd),
+			Dates:   occ,
+		})
+	}
+	return days
+}
+
+// Returns the first and last day, excluded, of the grid of the month: the month itself
+// plus the leading and trailing days completing its first and last week
+func monthGridBounds(year, month int, weekStart time.Weekday) (time.Time, time.Time) {
+	first := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	next := first.AddDate(0, 1, 0)
+	leading := (int(first.Weekday()) - int(weekStart) + 7) % 7
+	trailing := (int(weekStart) - int(next.Weekday()) + 7) % 7
+	return first.AddDate(0, 0, -leading), next.AddDate(0, 0, trailing)
+}
+
+// Splits the grid of a month in weeks
+func monthView(year, month int, weekStart time.Weekday, days []CalendarDay) MonthView {
+	view := MonthView{
+		Year:      year,
+		Month:     month,
+		WeekStart: weekStart.String(),
+		Weeks:     []CalendarWeek{},
+	}
+	for i := 0; i+7 <= len(days); i += 7 {
+		week := CalendarWeek{Days: days[i : i+7]}
+		for _, d := range week.Days {
+			if d.Weekday == time.Monday.String() {
+				t, _ := time.Parse(DAY_LAYOUT, d.Date)
+				week.ISOYear, week.ISOWeek = t.ISOWeek()
+			}
+		}
+		view.Weeks = append(view.Weeks, week)
+	}
+	return view
+}
+
+// Error reported for a calendar path segment out of its bounds
+func pathBoundsError(param string, lo, hi int) *ParamError {
+	return &ParamError{Param: param, Reason: fmt.Sprintf("must be between %d and %d", lo, hi)}
+}
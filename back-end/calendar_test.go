@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseWeekday(t *testing.T) {
+	for in, want := range map[string]time.Weekday{
+		"":       time.Monday,
+		"sunday": time.Sunday,
+		"Sunday": time.Sunday,
+		"FRIDAY": time.Friday,
+	} {
+		got, err := parseWeekday(in)
+		if err != nil || got != want {
+			t.Errorf("parseWeekday(%q) = %v, %v, want %v", in, got, err, want)
+		}
+	}
+	var pe *ParamError
+	if _, err := parseWeekday("mon"); !errors.As(err, &pe) || pe.Param != WEEK_START {
+		t.Errorf("parseWeekday(mon) = %v, want a ParamError on %s", err, WEEK_START)
+	}
+}
+
+func TestISOWeekStart(t *testing.T) {
+	tests := []struct {
+		year, week int
+		start      string
+		ok         bool
+	}{
+		{2024, 1, "2024-01-01", true},
+		// the first ISO week of 2021 starts in 2021-01-04, the days before belong to 2020
+		{2021, 1, "2021-01-04", true},
+		{2020, 53, "2020-12-28", true},
+		{2021, 53, "", false},
+		{2024, 0, "", false},
+	}
+	for _, tt := range tests {
+		start, ok := isoWeekStart(tt.year, tt.week)
+		if ok != tt.ok || (ok && start.Format(DAY_LAYOUT) != tt.start) {
+			t.Errorf("isoWeekStart(%d, %d) = %s, %v, want %s, %v", tt.year, tt.week, start.Format(DAY_LAYOUT), ok, tt.start, tt.ok)
+		}
+	}
+}
+
+func TestMonthGridBounds(t *testing.T) {
+	tests := []struct {
+		year, month int
+		weekStart   time.Weekday
+		start, end  string
+	}{
+		// february 2021 starts on a monday and lasts exactly 4 weeks
+		{2021, 2, time.Monday, "2021-02-01", "2021-03-01"},
+		{2021, 2, time.Sunday, "2021-01-31", "2021-03-07"},
+		{2024, 9, time.Monday, "2024-08-26", "2024-10-07"},
+	}
+	for _, tt := range tests {
+		start, end := monthGridBounds(tt.year, tt.month, tt.weekStart)
+		if start.Format(DAY_LAYOUT) != tt.start || end.Format(DAY_LAYOUT) != tt.end {
+			t.Errorf("monthGridBounds(%d, %d, %v) = %s, %s, want %s, %s", tt.year, tt.month, tt.weekStart,
+				start.Format(DAY_LAYOUT), end.Format(DAY_LAYOUT), tt.start, tt.end)
+		}
+		if days := int(end.Sub(start).Hours() / 24); days%7 != 0 {
+			t.Errorf("grid of %d-%d has %d days", tt.year, tt.month, days)
+		}
+	}
+}
+
+func TestMonthView(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	dates := []Date{
+		{Type: "birthday", Year: 2000, Month: 2, Day: 29},
+		{Type: "meeting", Year: 2025, Month: 2, Day: 14, Hours: 9},
+		{Type: "meeting", Year: 2025, Month: 2, Day: 14, Hours: 8},
+		{Type: "meeting", Year: 2024, Month: 2, Day: 14},
+	}
+	start, end := monthGridBounds(2025, 2, time.Monday)
+	inStart := time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)
+	view := monthView(2025, 2, time.Monday, calendarDays(dates, start, end, inStart, inStart.AddDate(0, 1, 0), now))
+
+	if len(view.Weeks) != 5 {
+		t.Fatalf("%d weeks, want 5", len(view.Weeks))
+	}
+	first := view.Weeks[0]
+	if first.ISOYear != 2025 || first.ISOWeek != 5 || first.Days[0].Date != "2025-01-27" || first.Days[0].InRange {
+		t.Errorf("unexpected first week %+v", first)
+	}
+	if !first.Days[5].InRange || first.Days[5].Date != "2025-02-01" {
+		t.Errorf("unexpected first day of the month %+v", first.Days[5])
+	}
+
+	byDay := map[string]CalendarDay{}
+	for _, w := range view.Weeks {
+		for _, d := range w.Days {
+			byDay[d.Date] = d
+		}
+	}
+	// the birthday of the 29th of february falls on the 28th in common years
+	if occ := byDay["2025-02-28"].Dates; len(occ) != 1 || occ[0].Years != 25 {
+		t.Errorf("unexpected occurrences on 2025-02-28: %+v", occ)
+	}
+	// dates occurring once are placed chronologically, the past ones are not repeated
+	occ := byDay["2025-02-14"].Dates
+	if len(occ) != 2 || occ[0].Date.Hours != 8 || occ[1].Date.Hours != 9 {
+		t.Errorf("unexpected occurrences on 2025-02-14: %+v", occ)
+	}
+	if occ := byDay["2025-02-15"].Dates; occ == nil || len(occ) != 0 {
+		t.Errorf("empty day has %+v, want an empty list", occ)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/cors"
+)
+
+const ENV_DEVELOPMENT = "development"
+
+var (
+	environment     string
+	corsOrigins     string
+	corsMethods     string
+	corsHeaders     string
+	corsCredentials bool
+	corsMaxAge      time.Duration
+)
+
+// Origins allowed by default in each environment, used when no origin is configured.
+// Only development has defaults, the origins of the other environments must be
+// configured. An origin may contain a single wildcard, e.g. https://*.example.com
+var corsOriginsByEnv = map[string][]string{
+	ENV_DEVELOPMENT: {"http://localhost:*", "http://127.0.0.1:*"},
+	"staging":       {},
+	"production":    {},
+}
+
+// Splits a comma separated list, dropping the blank items
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, MULTI_SEL_SEPARATOR) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Builds the CORS policy from the configuration. The allowed origins are the configured
+// ones or, if none is, the ones of the environment. Fails if that leaves no origin,
+// rather than silently blocking every browser.
+func newCorsOptions() (cors.Options, error) {
+	origins, ok := corsOriginsByEnv[environment]
+	if !ok {
+		return cors.Options{}, fmt.Errorf("unknown environment %q", environment)
+	}
+	if configured := splitList(corsOrigins); len(configured) > 0 {
+		origins = configured
+	}
+	if len(origins) == 0 {
+		return cors.Options{}, fmt.Errorf("no origin allowed in %s, set -cors-origins", environment)
+	}
+
+	for _, o := range origins {
+		if o == "*" && corsCredentials {
+			return cors.Options{}, fmt.Errorf("credentials cannot be allowed for every origin")
+		}
+		if strings.Count(o, "*") > 1 {
+			return cors.Options{}, fmt.Errorf("origin %q has more than one wildcard", o)
+		}
+	}
+
+	return cors.Options{
+		AllowedOrigins:   origins,
+		AllowedMethods:   splitList(corsMethods),
+		AllowedHeaders:   splitList(corsHeaders),
+		ExposedHeaders:   []string{REQUEST_ID_HEADER},
+		AllowCredentials: corsCredentials,
+		MaxAge:           int(corsMaxAge.Seconds()),
+	}, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewCorsOptions(t *testing.T) {
+	defer func(env, origins string) { environment, corsOrigins = env, origins }(environment, corsOrigins)
+
+	tests := []struct {
+		env, origins string
+		want         []string
+		ok           bool
+	}{
+		{ENV_DEVELOPMENT, "", corsOriginsByEnv[ENV_DEVELOPMENT], true},
+		{"production", "https://app.example.com, https://*.example.com", []string{"https://app.example.com", "https://*.example.com"}, true},
+		// an empty allow-list would block every browser
+		{"production", "", nil, false},
+		{"staging", " , ", nil, false},
+		{"testing", "https://app.example.com", nil, false},
+	}
+	for _, tt := range tests {
+		environment, corsOrigins = tt.env, tt.origins
+		opts, err := newCorsOptions()
+		if (err == nil) != tt.ok || (tt.ok && !reflect.DeepEqual(opts.AllowedOrigins, tt.want)) {
+			t.Errorf("newCorsOptions in %s with %q = %v, %v", tt.env, tt.origins, opts.AllowedOrigins, err)
+		}
+	}
+}
@@ -1,18 +1,58 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	db "remindal/internal/database"
+	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+var OWNER_KEY = "owner"
 var errNoDateIDProvided = errors.New("no id provided for the date")
 
+// Registered user the dates created before they had an owner are given to on startup.
+// Until then nobody but admins can see them.
+var orphanDatesOwner string
+
+// Gives the dates without an owner to the user of the orphan-dates-owner flag, retrying
+// until the database can be reached
+func adoptOrphanDates(ctx context.Context) {
+	owner := normalizeEmail(orphanDatesOwner)
+	retry(ctx, "adoptOrphanDates", func(ctx context.Context) error {
+		var user User
+		err := db.GetOne(ctx, db.USER_COLLECTION, EMAIL_KEY, owner, &user)
+		if errors.Is(err, db.ErrNotFound) {
+			slog.Warn("adoptOrphanDates - user not registered", "user", owner)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		query := bson.D{{Key: OWNER_KEY, Value: bson.D{{Key: "$exists", Value: false}}}}
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: OWNER_KEY, Value: owner}}}}
+		n, err := db.UpdateMany(ctx, db.CALENDAR_COLLECTION, query, update)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			slog.Info("dates without owner adopted", "user", owner, "count", n)
+		}
+		return nil
+	})
+}
+
+// Restricts the query to the dates of the user making the request
+func addOwnerFilter(r *http.Request, b *db.QueryBuilder) {
+	b.AddField(OWNER_KEY, principalOf(r).Email)
+}
+
 // Handles requests to retrieve a list of dates based on query parameters.
 //
 // Converts the query parameters to a MongoDB query, retrieves the matching
@@ -24,26 +64,91 @@ func GetDateListHandler(w http.ResponseWriter, r *http.Request) {
 		query   = r.URL.Query()
 	)
 	buildDateQuery(query, &builder)
+	addOwnerFilter(r, &builder)
 	err := builder.Err()
 	if err != nil {
 		Eres(w, Err400(err))
 		return
 	}
 
-	sort := db.CreateSort("year", -1)
+	sort := dateListSort(query)
 	d := []Date{}
-	err = db.GetMany(db.CALENDAR_COLLECTION, builder.Query(), sort, &d)
+	err = db.GetMany(r.Context(), db.CALENDAR_COLLECTION, builder.Query(), sort, &d)
 	if err != nil {
-		log.Println("GetDateListHandler - db.GetMany ", err)
-		Eres(w, Err500(err))
+		logger(r).Error("GetDateListHandler - db.GetMany", "err", err)
+		Eres(w, ErrFrom(err))
 		return
 	}
 	Okres(w, d)
 }
 
+// Handles requests to retrieve statistics about the dates matching the query parameters.
+//
+// Accepts the same filters as [GetDateListHandler] and counts the matching dates by type,
+// label, month and weekday, along with the busiest month and the next upcoming date of
+// each type. If an error occurs, it responds with the appropriate error message and status code.
+func GetDateStatsHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		builder = db.NewQueryBuilder()
+		query   = r.URL.Query()
+	)
+	buildDateQuery(query, &builder)
+	addOwnerFilter(r, &builder)
+	err := builder.Err()
+	if err != nil {
+		Eres(w, Err400(err))
+		return
+	}
+
+	var stats DateStats
+	err = db.GetDateStats(r.Context(), builder.Query(), time.Now().UTC(), &stats)
+	if err != nil {
+		logger(r).Error("GetDateStatsHandler - db.GetDateStats", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	Okres(w, stats.WithEmptyLists())
+}
+
+// Handles requests to retrieve the dates occurring from now on.
+//
+// Reads how far to look ahead and how many occurrences to return from the query parameters,
+// along with the optional type and labels filters, and writes the next occurrences
+// chronologically as a JSON response. Yearly types like birthdays always have a next
+// occurrence, their anniversary. If an error occurs, it responds with the appropriate
+// error message and status code.
+func GetUpcomingDatesHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		builder = db.NewQueryBuilder()
+		query   = r.URL.Query()
+		now     = time.Now().UTC()
+	)
+	within, limit, err := parseUpcomingParams(query)
+	builder.AddErr(err)
+	query.Del(WITHIN)
+	query.Del(LIMIT)
+	agendaFilters.build(query, &builder)
+	addOwnerFilter(r, &builder)
+	err = builder.Err()
+	if err != nil {
+		Eres(w, Err400(err))
+		return
+	}
+
+	end := now.Add(within)
+	d, err := datesBetween(r.Context(), builder.Query(), now, end)
+	if err != nil {
+		logger(r).Error("GetUpcomingDatesHandler - datesBetween", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	Okres(w, upcomingOccurrences(d, now, end, limit))
+}
+
 // Handles requests to delete a date from the database based on its id.
 //
 // Retrieves the id from the query parameters and deletes the date from the database.
+// Users can only delete their own dates, the ones of others are reported as not found.
 // If an error occurs, it responds with the appropriate error message and status code.
 func DelDateHandler(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get("_id")
@@ -54,14 +159,17 @@ func DelDateHandler(w http.ResponseWriter, r *http.Request) {
 
 	objID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		log.Println("DelDateHandler - primitive.ObjectIDFromHex ", err)
-		Eres(w, Err500(err))
+		Eres(w, Err400(&ParamError{Param: "_id", Reason: "must be a valid id"}))
 		return
 	}
 
-	err = db.DeleteOne(db.CALENDAR_COLLECTION, "_id", objID)
+	filter := bson.D{{Key: "_id", Value: objID}}
+	if p := principalOf(r); !p.IsAdmin() {
+		filter = append(filter, bson.E{Key: OWNER_KEY, Value: p.Email})
+	}
+	err = db.DeleteOneMatching(r.Context(), db.CALENDAR_COLLECTION, filter)
 	if err != nil {
-		Eres(w, Err400(err))
+		Eres(w, ErrFrom(err))
 		return
 	}
 	Okres(w, nil)
@@ -70,12 +178,12 @@ func DelDateHandler(w http.ResponseWriter, r *http.Request) {
 // Handles requests to add a new date to the database.
 //
 // Reads the request body, unmarshals the JSON into a Date, and inserts the date
-// into the database. If an error occurs, it responds with the appropriate error
-// message and status code.
+// into the database, owned by the user making the request. If an error occurs, it
+// responds with the appropriate error message and status code.
 func PutDateHandler(w http.ResponseWriter, r *http.Request) {
 	jsn, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Println("PutCalendarHandler - io.ReadAll ", err)
+		logger(r).Error("PutCalendarHandler - io.ReadAll", "err", err)
 		Eres(w, Err500(err))
 		return
 	}
@@ -83,22 +191,21 @@ func PutDateHandler(w http.ResponseWriter, r *http.Request) {
 	var d Date
 	err = json.Unmarshal(jsn, &d)
 	if err != nil {
-		log.Println("PutCalendarHandler - json.Unmarshal ", err)
-		Eres(w, Err500(err))
+		Eres(w, Err400(err))
 		return
 	}
 
-	validate := newCustomDateValidator()
 	err = validate.Struct(d)
 	if err != nil {
-		Eres(w, Err400(err))
+		Eres(w, Err400(localize(err, r)))
 		return
 	}
+	d.Owner = principalOf(r).Email
 
-	err = db.PutOne(db.CALENDAR_COLLECTION, d)
+	err = db.PutOne(r.Context(), db.CALENDAR_COLLECTION, d)
 	if err != nil {
-		log.Println("PutCalendarHandler - db.PutOne ", err)
-		Eres(w, Err500(err))
+		logger(r).Error("PutCalendarHandler - db.PutOne", "err", err)
+		Eres(w, ErrFrom(err))
 		return
 	}
 	Okres(w, nil)
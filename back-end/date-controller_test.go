@@ -0,0 +1,17 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDateStatsEmptyLists(t *testing.T) {
+	b, err := json.Marshal(DateStats{}.WithEmptyLists())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"byType":[],"byLabel":[],"byMonth":[],"byWeekday":[],"nextPerType":[]}`
+	if string(b) != want {
+		t.Errorf("empty statistics = %s, want %s", b, want)
+	}
+}
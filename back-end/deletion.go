@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	db "remindal/internal/database"
+	"remindal/internal/mail"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// How long a deleted account can be restored before its data is erased
+var deletionGrace time.Duration
+
+var (
+	errAccountPurging       = errors.New("the account is being deleted and cannot be restored anymore")
+	errDeletionNotScheduled = errors.New("the deletion of the account is not scheduled")
+)
+
+// Schedules the deletion of the user after the grace period and logs the user out
+// everywhere, API keys included. Asking again keeps the time first scheduled.
+// Returns when the account will be deleted.
+func scheduleDeletion(r *http.Request, email string) (time.Time, error) {
+	deleteAt := time.Now().UTC().Add(deletionGrace)
+	query := bson.D{
+		{Key: EMAIL_KEY, Value: email},
+		{Key: "deleteAt", Value: bson.D{{Key: "$exists", Value: false}}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "deleteAt", Value: deleteAt}}}}
+	err := db.UpdateOneMatching(r.Context(), db.USER_COLLECTION, query, update)
+	if errors.Is(err, db.ErrNotFound) {
+		// either already scheduled or not registered
+		var user User
+		if err := db.GetOne(r.Context(), db.USER_COLLECTION, EMAIL_KEY, email, &user); err != nil {
+			return time.Time{}, err
+		}
+		if user.DeleteAt == nil {
+			// restored in the meantime
+			return time.Time{}, errDeletionNotScheduled
+		}
+		return *user.DeleteAt, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if err := revokeSessions(r.Context(), email); err != nil {
+		return time.Time{}, err
+	}
+	if _, err := db.DeleteMany(r.Context(), db.APIKEY_COLLECTION, bson.D{{Key: "user", Value: email}}); err != nil {
+		return time.Time{}, err
+	}
+	audit(r.Context(), AUDIT_DELETION_SCHEDULED, email, auditActor(principalOf(r), email), map[string]any{"deleteAt": deleteAt})
+	sendEmail(r, mail.Message{
+		To:      email,
+		Subject: "Your Remindal account will be deleted",
+		Body: "Your Remindal account and every date in it will be deleted on " + deleteAt.Format(time.RFC1123) + ".\n\n" +
+			"Changed your mind? Log in before then to keep your account.\n",
+	})
+	return deleteAt, nil
+}
+
+// Cancels the scheduled deletion of the user. Returns [errAccountPurging] if the
+// deletion already started and [errDeletionNotScheduled] if there is none.
+func restoreAccount(ctx context.Context, email, actor string) error {
+	query := bson.D{
+		{Key: EMAIL_KEY, Value: email},
+		{Key: "deleteAt", Value: bson.D{{Key: "$exists", Value: true}}},
+		{Key: "purging", Value: bson.D{{Key: "$ne", Value: true}}},
+	}
+	update := bson.D{{Key: "$unset", Value: bson.D{{Key: "deleteAt", Value: ""}}}}
+	err := db.UpdateOneMatching(ctx, db.USER_COLLECTION, query, update)
+	if errors.Is(err, db.ErrNotFound) {
+		var user User
+		if err := db.GetOne(ctx, db.USER_COLLECTION, EMAIL_KEY, email, &user); err != nil {
+			return err
+		}
+		if user.Purging {
+			return errAccountPurging
+		}
+		return errDeletionNotScheduled
+	}
+	if err != nil {
+		return err
+	}
+	audit(ctx, AUDIT_DELETION_CANCELED, email, actor, nil)
+	return nil
+}
+
+// Handles requests of admins to cancel the scheduled deletion of a user.
+//
+// Retrieves the email from the query parameters and restores the user, who can log
+// in again. If an error occurs, it responds with the appropriate error message and
+// status code.
+func RestoreUserHandler(w http.ResponseWriter, r *http.Request) {
+	userEmail := normalizeEmail(r.URL.Query().Get(EMAIL_KEY))
+	if userEmail == "" {
+		Eres(w, Err400(errNoEmailProvided))
+		return
+	}
+
+	err := restoreAccount(r.Context(), userEmail, auditActor(principalOf(r), userEmail))
+	if errors.Is(err, errAccountPurging) || errors.Is(err, errDeletionNotScheduled) {
+		Eres(w, Err409(err))
+		return
+	}
+	if err != nil {
+		logger(r).Error("RestoreUserHandler - restoreAccount", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	Okres(w, nil)
+}
+
+// Hands over or erases the data a feature keeps about the user being purged
+type purgeHook func(ctx context.Context, email string) error
+
+// Run in order by [purgeUser] before the user is deleted. Remindal has no shared
+// calendars, sharing grants nor notification state yet, so none is registered and the
+// purge does not transfer or clear them. The features adding them must register the
+// transfer of the shared calendars and the cleanup of their state here. A failing hook
+// stops the purge, which the next one resumes, so hooks must be safe to run again.
+var purgeHooks []purgeHook
+
+// Erases the user and every piece of data of the user: the dates, the sessions, the
+// tokens sent by email, the API keys, the exports, the avatar and whatever the
+// [purgeHooks] take care of. The user is marked first, so that it cannot be restored
+// halfway, and deleted last, so that a failed purge is resumed by the next one.
+// Nothing is erased unless the user still matches the query.
+func purgeUser(ctx context.Context, user User, due bson.D) error {
+	query := append(bson.D{{Key: EMAIL_KEY, Value: user.Email}}, due...)
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "purging", Value: true}}}}
+	err := db.UpdateOneMatching(ctx, db.USER_COLLECTION, query, update)
+	if errors.Is(err, db.ErrNotFound) {
+		// restored in the meantime
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range purgeHooks {
+		if err := hook(ctx, user.Email); err != nil {
+			return err
+		}
+	}
+	owned := bson.D{{Key: "user", Value: user.Email}}
+	dates, err := db.DeleteMany(ctx, db.CALENDAR_COLLECTION, bson.D{{Key: OWNER_KEY, Value: user.Email}})
+	if err != nil {
+		return err
+	}
+	for _, coll := range []string{db.SESSION_COLLECTION, db.TOKEN_COLLECTION, db.APIKEY_COLLECTION} {
+		if _, err := db.DeleteMany(ctx, coll, owned); err != nil {
+			return err
+		}
+	}
+	if err := removeExports(ctx, user.Email); err != nil {
+		return err
+	}
+	removeAvatar(user.Avatar)
+	err = db.DeleteOneMatching(ctx, db.USER_COLLECTION, bson.D{{Key: EMAIL_KEY, Value: user.Email}, {Key: "purging", Value: true}})
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return err
+	}
+	audit(ctx, AUDIT_ACCOUNT_PURGED, user.Email, AUDIT_SYSTEM, map[string]any{"dates": dates})
+	return nil
+}
+
+// Erases the users whose grace period is over, every interval until the context is done
+func purgeDeleted(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var users []User
+			query := bson.D{{Key: "deleteAt", Value: bson.D{{Key: "$lte", Value: time.Now().UTC()}}}}
+			if err := db.GetMany(ctx, db.USER_COLLECTION, query, db.CreateSort("deleteAt", 1), &users); err != nil {
+				slog.Error("purgeDeleted - db.GetMany", "err", err)
+				continue
+			}
+			for _, u := range users {
+				if err := purgeUser(ctx, u, query); err != nil {
+					slog.Error("purgeDeleted - purgeUser", "err", err)
+					continue
+				}
+				slog.Info("purged deleted user")
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	db "remindal/internal/database"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Returns the email as users are stored by. Emails are lowercased once on the way in,
+// at sign-up, login and every lookup, so that they are compared exactly everywhere
+// else and two accounts never differ only by case.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Moves the users registered before emails were lowercased to their lowercased email,
+// along with their dates, API keys and exports. Their sessions and the tokens sent by
+// email are dropped, they log in again. Users whose lowercased email is already taken
+// by another account are left as they are and logged, an admin has to merge or delete
+// one of them. Safe to run again after a failure.
+func normalizeEmails(ctx context.Context) {
+	retry(ctx, "normalizeEmails", func(ctx context.Context) error {
+		var users []User
+		query := bson.D{{Key: EMAIL_KEY, Value: bson.D{{Key: "$regex", Value: "[A-Z]|^\\s|\\s$"}}}}
+		if err := db.GetMany(ctx, db.USER_COLLECTION, query, db.CreateSort(EMAIL_KEY, 1), &users); err != nil {
+			return err
+		}
+		for _, u := range users {
+			if err := moveUser(ctx, u, normalizeEmail(u.Email)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Moves the user and the data it owns to the email, see [normalizeEmails]
+func moveUser(ctx context.Context, user User, email string) error {
+	var taken User
+	err := db.GetOne(ctx, db.USER_COLLECTION, EMAIL_KEY, email, &taken)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return err
+	}
+	// the copy inserted by a previous run that failed before deleting the user
+	resumed := err == nil && taken.CreatedAt.Equal(user.CreatedAt) && taken.Password == user.Password
+	if err == nil && !resumed {
+		slog.Warn("normalizeEmails - lowercased email already registered", "user", user.Email)
+		return nil
+	}
+
+	from := bson.D{{Key: "user", Value: user.Email}}
+	to := bson.D{{Key: "$set", Value: bson.D{{Key: "user", Value: email}}}}
+	for _, coll := range []string{db.APIKEY_COLLECTION, db.EXPORT_COLLECTION} {
+		if _, err := db.UpdateMany(ctx, coll, from, to); err != nil {
+			return err
+		}
+	}
+	owned := bson.D{{Key: OWNER_KEY, Value: user.Email}}
+	owner := bson.D{{Key: "$set", Value: bson.D{{Key: OWNER_KEY, Value: email}}}}
+	if _, err := db.UpdateMany(ctx, db.CALENDAR_COLLECTION, owned, owner); err != nil {
+		return err
+	}
+	for _, coll := range []string{db.SESSION_COLLECTION, db.TOKEN_COLLECTION} {
+		if _, err := db.DeleteMany(ctx, coll, from); err != nil {
+			return err
+		}
+	}
+
+	if !resumed {
+		moved := user
+		moved.Email = email
+		if err := db.PutOne(ctx, db.USER_COLLECTION, moved); err != nil {
+			return err
+		}
+	}
+	if err := db.DeleteOne(ctx, db.USER_COLLECTION, EMAIL_KEY, user.Email); err != nil && !errors.Is(err, db.ErrNotFound) {
+		return err
+	}
+	slog.Info("normalizeEmails - user moved to its lowercased email", "user", email)
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	db "remindal/internal/database"
+	"remindal/internal/logging"
+	"remindal/internal/mail"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Ways the emails can be delivered
+const (
+	MAILER_LOG  = "log"
+	MAILER_SMTP = "smtp"
+)
+
+// Environment variable holding the password of the SMTP server, kept out of the flags
+// so that it does not show up in the process list
+const SMTP_PASSWORD_ENV = "REMINDAL_SMTP_PASSWORD"
+
+var (
+	mailer    string
+	smtpAddr  string
+	smtpUser  string
+	mailFrom  string
+	publicURL string
+
+	mailSender mail.Sender
+)
+
+var errInvalidEmailToken = errors.New("invalid, expired or already used token")
+
+// Sets up the delivery of the emails
+func newMailSender() error {
+	switch mailer {
+	case MAILER_LOG:
+		if environment != ENV_DEVELOPMENT {
+			return fmt.Errorf("the log mailer sends no email and is only allowed in %s, use %s", ENV_DEVELOPMENT, MAILER_SMTP)
+		}
+		mailSender = mail.LogSender{}
+	case MAILER_SMTP:
+		if smtpAddr == "" || mailFrom == "" {
+			return errors.New("the smtp mailer requires -smtp-addr and -mail-from")
+		}
+		mailSender = mail.SMTPSender{
+			Addr:     smtpAddr,
+			Username: smtpUser,
+			Password: os.Getenv(SMTP_PASSWORD_ENV),
+			From:     mailFrom,
+		}
+	default:
+		return fmt.Errorf("unknown mailer %q, must be %s or %s", mailer, MAILER_LOG, MAILER_SMTP)
+	}
+	if resetPasswordURL != "" {
+		if u, err := url.Parse(resetPasswordURL); err != nil || !u.IsAbs() {
+			return fmt.Errorf("invalid -reset-password-url %q, must be an absolute URL", resetPasswordURL)
+		}
+	}
+	return nil
+}
+
+// Sends the email in the background, so that the response does not wait for the mail
+// server. Failures are logged with the logger of the request.
+func sendEmail(r *http.Request, m mail.Message) {
+	log := logger(r)
+	workers.Go("mail", func(ctx context.Context) {
+		ctx = logging.WithLogger(ctx, log)
+		if err := mailSender.Send(ctx, m); err != nil {
+			log.Error("sendEmail - mailSender.Send", "err", err, "subject", m.Subject)
+		}
+	})
+}
+
+// Returns the public URL of the path with the query parameters
+func link(path string, query url.Values) string {
+	return strings.TrimRight(publicURL, "/") + path + "?" + query.Encode()
+}
+
+// Returns the URL of the client page with the query parameters added to its own
+func pageLink(page string, query url.Values) string {
+	u, err := url.Parse(page)
+	if err != nil {
+		// checked on startup
+		return page
+	}
+	q := u.Query()
+	for k, vs := range query {
+		q[k] = vs
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Issues a single use token of the kind for the user, valid for ttl. Tokens of the same
+// kind issued before to the user are revoked, so that only the last one sent works.
+func issueEmailToken(ctx context.Context, kind, email string, ttl time.Duration) (string, error) {
+	_, err := db.DeleteMany(ctx, db.TOKEN_COLLECTION, bson.D{{Key: "user", Value: email}, {Key: "kind", Value: kind}})
+	if err != nil {
+		return "", err
+	}
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	t := EmailToken{
+		ID:        hashToken(token),
+		Kind:      kind,
+		User:      email,
+		ExpiresAt: time.Now().UTC().Add(ttl),
+	}
+	return token, db.PutOne(ctx, db.TOKEN_COLLECTION, t)
+}
+
+// Consumes the token of the kind, which cannot be used again afterwards. Returns
+// [errInvalidEmailToken] if it does not exist, expired or was already used.
+func consumeEmailToken(ctx context.Context, kind, token string) (EmailToken, error) {
+	var t EmailToken
+	query := bson.D{{Key: "_id", Value: hashToken(token)}, {Key: "kind", Value: kind}}
+	err := db.TakeOne(ctx, db.TOKEN_COLLECTION, query, &t)
+	if errors.Is(err, db.ErrNotFound) {
+		return t, errInvalidEmailToken
+	}
+	if err != nil {
+		return t, err
+	}
+	// expired tokens are removed by the database in the background, not right away
+	if time.Now().After(t.ExpiresAt) {
+		return t, errInvalidEmailToken
+	}
+	return t, nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestPageLink(t *testing.T) {
+	tests := []struct {
+		page, want string
+	}{
+		{"https://app.example.com/reset", "https://app.example.com/reset?token=a%2Bb"},
+		// the own parameters of the page are kept
+		{"https://app.example.com/reset?lang=it", "https://app.example.com/reset?lang=it&token=a%2Bb"},
+	}
+	for _, tt := range tests {
+		if got := pageLink(tt.page, url.Values{TOKEN_KEY: {"a+b"}}); got != tt.want {
+			t.Errorf("pageLink(%q) = %s, want %s", tt.page, got, tt.want)
+		}
+	}
+}
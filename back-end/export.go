@@ -0,0 +1,383 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	db "remindal/internal/database"
+	"remindal/internal/ical"
+	"remindal/internal/logging"
+	"remindal/internal/mail"
+	"remindal/internal/ratelimit"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// States of an export
+const (
+	EXPORT_PENDING = "pending"
+	EXPORT_READY   = "ready"
+	EXPORT_FAILED  = "failed"
+)
+
+// How long an export can stay pending before another one can be asked for
+const EXPORT_TIMEOUT = time.Hour
+
+// Product identifier of the exported calendars
+const ICAL_PRODID = "-//Remindal//Data export//EN"
+
+var (
+	exportDir          string
+	exportTTL          time.Duration
+	exportRequestLimit = ratelimit.Limit{Count: 3, Period: 24 * time.Hour}
+)
+
+var (
+	errExportPending  = errors.New("an export is already being prepared")
+	errExportNotFound = errors.New("invalid or expired export link")
+	errExportNotReady = errors.New("the export is not ready yet")
+)
+
+// Returns the path of the archive of the export
+func exportPath(id string) string {
+	return filepath.Join(exportDir, filepath.Base(id)+".zip")
+}
+
+// Adds the value to the archive as an indented JSON file
+func writeJSON(zw *zip.Writer, name string, v any) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// Returns the dates as calendar events
+func dateEvents(dates []Date) []ical.Event {
+	events := make([]ical.Event, 0, len(dates))
+	for _, d := range dates {
+		events = append(events, ical.Event{
+			UID:         d.ID + "@remindal",
+			Start:       time.Date(int(d.Year), time.Month(d.Month), int(d.Day), int(d.Hours), int(d.Minutes), 0, 0, time.UTC),
+			AllDay:      d.Hours == 0 && d.Minutes == 0,
+			Summary:     d.Type,
+			Description: d.Desc,
+			Categories:  d.Labels,
+		})
+	}
+	return events
+}
+
+// Adds the data a feature keeps about the user to the archive of the export
+type exportHook func(ctx context.Context, zw *zip.Writer, email string) error
+
+// Run in order by [writeExport] once the files of the account are written. Remindal
+// keeps no sharing grants nor notification history yet, so none is registered and the
+// archive does not contain them. The features adding them must register their data
+// here.
+var exportHooks []exportHook
+
+// Writes the archive with every piece of data of the user: the profile, the dates as
+// JSON and as an iCalendar file, the API keys, the audit trail, the avatar and whatever
+// the [exportHooks] add
+func writeExport(ctx context.Context, out io.Writer, email string) error {
+	var user User
+	if err := db.GetOne(ctx, db.USER_COLLECTION, EMAIL_KEY, email, &user); err != nil {
+		return err
+	}
+	dates := []Date{}
+	if err := db.GetMany(ctx, db.CALENDAR_COLLECTION, bson.D{{Key: OWNER_KEY, Value: email}}, db.CreateSort(YEAR, 1), &dates); err != nil {
+		return err
+	}
+	keys := []APIKey{}
+	if err := db.GetMany(ctx, db.APIKEY_COLLECTION, bson.D{{Key: "user", Value: email}}, db.CreateSort("createdAt", 1), &keys); err != nil {
+		return err
+	}
+	trail := []AuditEntry{}
+	if err := db.GetMany(ctx, db.AUDIT_COLLECTION, bson.D{{Key: "user", Value: auditKey(email)}}, db.CreateSort("at", 1), &trail); err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(out)
+	if err := writeJSON(zw, "profile.json", user.Public()); err != nil {
+		return err
+	}
+	if err := writeJSON(zw, "dates.json", dates); err != nil {
+		return err
+	}
+	f, err := zw.Create("dates.ics")
+	if err != nil {
+		return err
+	}
+	if err := ical.Write(f, ICAL_PRODID, dateEvents(dates)); err != nil {
+		return err
+	}
+	if err := writeJSON(zw, "apikeys.json", keys); err != nil {
+		return err
+	}
+	if err := writeJSON(zw, "audit.json", trail); err != nil {
+		return err
+	}
+	if user.Avatar != "" {
+		b, err := os.ReadFile(avatarPath(user.Avatar))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err == nil {
+			f, err := zw.Create("avatar" + filepath.Ext(user.Avatar))
+			if err != nil {
+				return err
+			}
+			if _, err := f.Write(b); err != nil {
+				return err
+			}
+		}
+	}
+	for _, hook := range exportHooks {
+		if err := hook(ctx, zw, email); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// Builds the archive of the export, then marks it ready and sends the download link.
+// The archive is written to a temporary file first, so that it is never downloaded
+// while incomplete.
+func runExport(ctx context.Context, e DataExport, token string) {
+	log := logging.FromContext(ctx)
+	err := func() error {
+		tmp, err := os.CreateTemp(exportDir, "export-*.tmp")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		if err := writeExport(ctx, tmp, e.User); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			return err
+		}
+		return os.Rename(tmp.Name(), exportPath(e.ID))
+	}()
+
+	status := EXPORT_READY
+	if err != nil {
+		log.Error("runExport - writeExport", "err", err)
+		status = EXPORT_FAILED
+	}
+	if err := db.UpdateOne(ctx, db.EXPORT_COLLECTION, "_id", e.ID, bson.D{{Key: "status", Value: status}}); err != nil {
+		log.Error("runExport - db.UpdateOne", "err", err)
+		return
+	}
+	if status != EXPORT_READY {
+		return
+	}
+	if err := mailSender.Send(ctx, mail.Message{
+		To:      e.User,
+		Subject: "Your Remindal data is ready",
+		Body: "The copy of your Remindal data you asked for is ready.\n\n" +
+			"Download it by opening the link below:\n" +
+			link("/user/export/download", url.Values{TOKEN_KEY: {token}}) + "\n\n" +
+			"The link expires on " + e.ExpiresAt.Format(time.RFC1123) + ".\n",
+	}); err != nil {
+		log.Error("runExport - mailSender.Send", "err", err)
+	}
+}
+
+// Handles requests of the logged in user to export all of their data.
+//
+// Starts preparing an archive with the profile, the dates as JSON and iCalendar, the
+// API keys, the audit trail and the avatar of the user in the background. The download
+// link is sent by email once the archive is ready and written now as a JSON response,
+// it expires after a while. Each user can only ask for a few exports per period. If an
+// error occurs, it responds with the appropriate error message and status code.
+func PutExportHandler(w http.ResponseWriter, r *http.Request) {
+	email := principalOf(r).Email
+	// exports interrupted by a shutdown stay pending, they stop counting after a while
+	pending := bson.D{
+		{Key: "user", Value: email},
+		{Key: "status", Value: EXPORT_PENDING},
+		{Key: "createdAt", Value: bson.D{{Key: "$gt", Value: time.Now().UTC().Add(-EXPORT_TIMEOUT)}}},
+	}
+	var existing []DataExport
+	if err := db.GetMany(r.Context(), db.EXPORT_COLLECTION, pending, db.CreateSort("createdAt", -1), &existing); err != nil {
+		logger(r).Error("PutExportHandler - db.GetMany", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	if len(existing) > 0 {
+		Eres(w, Err409(errExportPending))
+		return
+	}
+
+	wait, err := limiter.Allow(r.Context(), "export:"+email, exportRequestLimit)
+	if err != nil {
+		logger(r).Error("PutExportHandler - limiter.Allow", "err", err)
+	}
+	if wait > 0 {
+		Eres(w, Err429(errRateLimited, wait))
+		return
+	}
+
+	token, err := newToken()
+	if err != nil {
+		logger(r).Error("PutExportHandler - newToken", "err", err)
+		Eres(w, Err500(err))
+		return
+	}
+	now := time.Now().UTC()
+	e := DataExport{
+		ID:        hashToken(token),
+		User:      email,
+		Status:    EXPORT_PENDING,
+		CreatedAt: now,
+		ExpiresAt: now.Add(exportTTL),
+	}
+	if err := db.PutOne(r.Context(), db.EXPORT_COLLECTION, e); err != nil {
+		logger(r).Error("PutExportHandler - db.PutOne", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	log := logger(r)
+	workers.Go("export", func(ctx context.Context) {
+		runExport(logging.WithLogger(ctx, log), e, token)
+	})
+
+	e.URL = link("/user/export/download", url.Values{TOKEN_KEY: {token}})
+	Okres(w, e)
+}
+
+// Handles requests of the logged in user to list their exports.
+//
+// Writes the exports that did not expire, newest first, as a JSON response. The
+// download links are not part of it. If an error occurs, it responds with the
+// appropriate error message and status code.
+func GetExportsHandler(w http.ResponseWriter, r *http.Request) {
+	exports := []DataExport{}
+	query := bson.D{
+		{Key: "user", Value: principalOf(r).Email},
+		{Key: "expireAt", Value: bson.D{{Key: "$gt", Value: time.Now().UTC()}}},
+	}
+	if err := db.GetMany(r.Context(), db.EXPORT_COLLECTION, query, db.CreateSort("createdAt", -1), &exports); err != nil {
+		logger(r).Error("GetExportsHandler - db.GetMany", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	Okres(w, exports)
+}
+
+// Handles requests to download an export with the link sent by email.
+//
+// Reads the token from the query parameters and writes the archive as an attachment.
+// The link can be used again until it expires, so that interrupted downloads can be
+// resumed. If an error occurs, it responds with the appropriate error message and
+// status code.
+func DownloadExportHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get(TOKEN_KEY)
+	if token == "" {
+		Eres(w, Err400(errNoTokenProvided))
+		return
+	}
+
+	var e DataExport
+	err := db.GetOne(r.Context(), db.EXPORT_COLLECTION, "_id", hashToken(token), &e)
+	// expired exports are removed by the database in the background, not right away
+	if errors.Is(err, db.ErrNotFound) || (err == nil && (time.Now().After(e.ExpiresAt) || e.Status == EXPORT_FAILED)) {
+		Eres(w, Err404(errExportNotFound))
+		return
+	}
+	if err != nil {
+		logger(r).Error("DownloadExportHandler - db.GetOne", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	if e.Status != EXPORT_READY {
+		Eres(w, Err409(errExportNotReady))
+		return
+	}
+
+	f, err := os.Open(exportPath(e.ID))
+	if errors.Is(err, os.ErrNotExist) {
+		Eres(w, Err404(errExportNotFound))
+		return
+	}
+	if err != nil {
+		logger(r).Error("DownloadExportHandler - os.Open", "err", err)
+		Eres(w, Err500(err))
+		return
+	}
+	defer f.Close()
+
+	name := "remindal-export-" + e.CreatedAt.Format("20060102") + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeContent(w, r, name, e.CreatedAt, f)
+}
+
+// Removes the exports of the user along with their archives
+func removeExports(ctx context.Context, email string) error {
+	var exports []DataExport
+	query := bson.D{{Key: "user", Value: email}}
+	if err := db.GetMany(ctx, db.EXPORT_COLLECTION, query, db.CreateSort("createdAt", 1), &exports); err != nil {
+		return err
+	}
+	for _, e := range exports {
+		if err := os.Remove(exportPath(e.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	_, err := db.DeleteMany(ctx, db.EXPORT_COLLECTION, query)
+	return err
+}
+
+// Creates the export directory if it does not exist
+func ensureExportDir() error {
+	if err := os.MkdirAll(exportDir, 0o700); err != nil {
+		return fmt.Errorf("creating the export directory: %w", err)
+	}
+	return nil
+}
+
+// Removes the archives older than the lifetime of the exports, whose entries were
+// already expired by the database, every interval until the context is done
+func purgeExports(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			entries, err := os.ReadDir(exportDir)
+			if err != nil {
+				slog.Error("purgeExports - os.ReadDir", "err", err)
+				continue
+			}
+			// temporary files of the exports interrupted by a shutdown are removed too
+			cutoff := time.Now().Add(-exportTTL)
+			for _, entry := range entries {
+				info, err := entry.Info()
+				if err != nil || !info.ModTime().Before(cutoff) {
+					continue
+				}
+				if err := os.Remove(filepath.Join(exportDir, entry.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+					slog.Error("purgeExports - os.Remove", "err", err)
+				}
+			}
+		}
+	}
+}
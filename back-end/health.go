@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	db "remindal/internal/database"
+	"remindal/internal/logging"
+	"sync/atomic"
+	"time"
+)
+
+// Status of the whole service and of each of its dependencies
+const (
+	STATUS_OK   = "ok"
+	STATUS_FAIL = "fail"
+)
+
+var (
+	readyTimeout  time.Duration
+	shutdownDelay time.Duration
+
+	// Set as soon as the shutdown starts, so that readiness fails while the in-flight
+	// requests are drained
+	shuttingDown atomic.Bool
+
+	// Long running workers that must be running for the service to be ready
+	requiredWorkers []string
+)
+
+// Outcome of the check of a dependency
+type HealthCheck struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latencyMs,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	Running   *int    `json:"running,omitempty"`
+}
+
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+// Checks that the database answers a ping before the readiness deadline. Only the kind
+// of failure is reported, as probes are unauthenticated, the whole error is logged.
+func checkDatabase(ctx context.Context) HealthCheck {
+	start := time.Now()
+	err := db.Ping(ctx)
+	check := HealthCheck{
+		Status:    STATUS_OK,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		logging.FromContext(ctx).Warn("checkDatabase - db.Ping", "err", err)
+		check.Status = STATUS_FAIL
+		check.Error = "database unreachable"
+		if errors.Is(err, db.ErrTimeout) {
+			check.Error = db.ErrTimeout.Error()
+		}
+	}
+	return check
+}
+
+// Checks that the indexes the queries rely on have been created
+func checkMigrations() HealthCheck {
+	if !db.IndexesEnsured() {
+		return HealthCheck{Status: STATUS_FAIL, Error: "indexes not created yet"}
+	}
+	return HealthCheck{Status: STATUS_OK}
+}
+
+// Checks that the background workers have not been stopped and that the long running
+// ones are still running
+func checkWorkers() HealthCheck {
+	running := workers.Running()
+	check := HealthCheck{Status: STATUS_OK, Running: &running}
+	if workers.Stopped() {
+		check.Status = STATUS_FAIL
+		check.Error = "workers stopped"
+		return check
+	}
+	for _, name := range requiredWorkers {
+		if !workers.IsRunning(name) {
+			check.Status = STATUS_FAIL
+			check.Error = "worker " + name + " is not running"
+			return check
+		}
+	}
+	return check
+}
+
+// Writes the report with 200 if the service is healthy, 503 otherwise
+func writeHealth(w http.ResponseWriter, report HealthReport) {
+	status := http.StatusOK
+	if report.Status != STATUS_OK {
+		status = http.StatusServiceUnavailable
+	}
+	res := ResponseAPI{Ok: status == http.StatusOK, Res: report}
+	if status != http.StatusOK {
+		res.Code = CODE_UNAVAILABLE
+	}
+
+	json, err := json.Marshal(res)
+	if err != nil {
+		slog.Error("writeHealth - json.Marshal", "err", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if _, err = w.Write(json); err != nil {
+		slog.Error("writeHealth - w.Write", "err", err)
+	}
+}
+
+// Handles liveness probes. Answers as long as the process is able to serve requests,
+// regardless of its dependencies.
+func LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, HealthReport{Status: STATUS_OK})
+}
+
+// Handles readiness probes.
+//
+// Checks that the database can be pinged within the readiness timeout, that the indexes
+// have been created and that the background workers are running, and writes the outcome
+// of each check as a JSON response. Responds with 503 if any of them fails or if the
+// server is shutting down.
+func ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	report := HealthReport{
+		Status: STATUS_OK,
+		Checks: map[string]HealthCheck{
+			"database":   checkDatabase(ctx),
+			"migrations": checkMigrations(),
+			"workers":    checkWorkers(),
+		},
+	}
+	if shuttingDown.Load() {
+		report.Checks["shutdown"] = HealthCheck{Status: STATUS_FAIL, Error: "shutting down"}
+	}
+	for _, c := range report.Checks {
+		if c.Status != STATUS_OK {
+			report.Status = STATUS_FAIL
+		}
+	}
+	writeHealth(w, report)
+}
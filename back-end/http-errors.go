@@ -1,22 +1,80 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	db "remindal/internal/database"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// Stable machine-readable codes of the errors, sent to the client along with the message
+const (
+	CODE_BAD_REQUEST       = "bad_request"
+	CODE_INVALID_PARAMS    = "invalid_params"
+	CODE_VALIDATION_FAILED = "validation_failed"
+	CODE_MALFORMED_BODY    = "malformed_body"
+	CODE_UNAUTHORIZED      = "unauthorized"
+	CODE_TOTP_REQUIRED     = "totp_required"
+	CODE_FORBIDDEN         = "forbidden"
+	CODE_NOT_FOUND         = "not_found"
+	CODE_CONFLICT          = "conflict"
+	CODE_TOO_MANY_REQUESTS = "too_many_requests"
+	CODE_INTERNAL          = "internal"
+	CODE_UNAVAILABLE       = "unavailable"
+	CODE_TIMEOUT           = "timeout"
+	CODE_CANCELED          = "canceled"
 )
 
 type HttpError struct {
 	err    error
 	status int
+	code   string
+	// how long the client should wait before retrying, sent in the Retry-After header when set
+	retryAfter time.Duration
 }
 
 func (he *HttpError) Error() string {
 	return fmt.Sprintf("%d: %s", he.status, he.err)
 }
 
+// Returns a 400 error. The code tells apart invalid query parameters, failed
+// validations and malformed JSON bodies from generic bad requests.
 func Err400(err error) *HttpError {
+	var (
+		ve  validator.ValidationErrors
+		le  *ValidationError
+		se  *json.SyntaxError
+		ute *json.UnmarshalTypeError
+	)
+	code := CODE_BAD_REQUEST
+	switch {
+	case errors.As(err, &ve), errors.As(err, &le):
+		code = CODE_VALIDATION_FAILED
+	case errors.As(err, &se), errors.As(err, &ute):
+		code = CODE_MALFORMED_BODY
+	case len(paramErrors(err)) > 0:
+		code = CODE_INVALID_PARAMS
+	}
 	return &HttpError{
 		err:    err,
 		status: 400,
+		code:   code,
+	}
+}
+
+// Returns a 401 error. The code tells apart the logins missing the second factor.
+func Err401(err error) *HttpError {
+	code := CODE_UNAUTHORIZED
+	if errors.Is(err, errTOTPRequired) {
+		code = CODE_TOTP_REQUIRED
+	}
+	return &HttpError{
+		err:    err,
+		status: 401,
+		code:   code,
 	}
 }
 
@@ -24,6 +82,33 @@ func Err403(err error) *HttpError {
 	return &HttpError{
 		err:    err,
 		status: 403,
+		code:   CODE_FORBIDDEN,
+	}
+}
+
+func Err404(err error) *HttpError {
+	return &HttpError{
+		err:    err,
+		status: 404,
+		code:   CODE_NOT_FOUND,
+	}
+}
+
+func Err409(err error) *HttpError {
+	return &HttpError{
+		err:    err,
+		status: 409,
+		code:   CODE_CONFLICT,
+	}
+}
+
+// Returns a 429 error telling the client to retry after the given duration
+func Err429(err error, retryAfter time.Duration) *HttpError {
+	return &HttpError{
+		err:        err,
+		status:     429,
+		code:       CODE_TOO_MANY_REQUESTS,
+		retryAfter: retryAfter,
 	}
 }
 
@@ -31,5 +116,55 @@ func Err500(err error) *HttpError {
 	return &HttpError{
 		err:    err,
 		status: 500,
+		code:   CODE_INTERNAL,
+	}
+}
+
+func Err503(err error) *HttpError {
+	return &HttpError{
+		err:    err,
+		status: 503,
+		code:   CODE_UNAVAILABLE,
+	}
+}
+
+func Err504(err error) *HttpError {
+	return &HttpError{
+		err:    err,
+		status: 504,
+		code:   CODE_TIMEOUT,
+	}
+}
+
+// Nonstandard status of the requests the client gave up on, never sent
+const STATUS_CLIENT_CLOSED_REQUEST = 499
+
+// Returns the error of a request the client gave up on. No response is written for
+// it, the status is only recorded in the logs and metrics.
+func Err499(err error) *HttpError {
+	return &HttpError{
+		err:    err,
+		status: STATUS_CLIENT_CLOSED_REQUEST,
+		code:   CODE_CANCELED,
+	}
+}
+
+// Maps an error returned by the database to the HTTP error with the matching status.
+// Unknown errors are reported as internal server errors.
+func ErrFrom(err error) *HttpError {
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		return Err404(err)
+	case errors.Is(err, db.ErrConflict):
+		return Err409(err)
+	case errors.Is(err, db.ErrUnavailable):
+		return Err503(err)
+	case errors.Is(err, db.ErrTimeout):
+		return Err504(err)
+	case errors.Is(err, db.ErrCanceled):
+		return Err499(err)
+	case errors.Is(err, db.ErrTooMany):
+		return Err400(err)
 	}
+	return Err500(err)
 }
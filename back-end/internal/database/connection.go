@@ -3,10 +3,13 @@ package database
 import (
 	"context"
 	_ "embed"
-	"log"
+	"fmt"
+	"log/slog"
+	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 var (
@@ -15,27 +18,75 @@ var (
 	DB_NAME             = "remindalDB"
 	CALENDAR_COLLECTION = "calendar"
 	USER_COLLECTION     = "users"
+	SESSION_COLLECTION  = "sessions"
+	TOKEN_COLLECTION    = "tokens"
+	APIKEY_COLLECTION   = "apikeys"
+	SETTINGS_COLLECTION = "settings"
+	AUDIT_COLLECTION    = "audit"
+	EXPORT_COLLECTION   = "exports"
 )
 
-// Closes connection to te Remindal database
-func closeConnection(client *mongo.Client) {
-	err := client.Disconnect(context.Background())
-	if err != nil {
-		log.Println("database.CloseConnection - client.Disconnect ", err)
-	}
+// Maximum duration of each kind of database operation
+type Timeouts struct {
+	Connect   time.Duration
+	Read      time.Duration
+	Write     time.Duration
+	Aggregate time.Duration
+}
+
+// Timeouts applied to the database operations, on top of the deadline of the caller's context.
+// Meant to be configured once at startup.
+var OpTimeouts = Timeouts{
+	Connect:   10 * time.Second,
+	Read:      5 * time.Second,
+	Write:     5 * time.Second,
+	Aggregate: 15 * time.Second,
 }
 
-// Opens connection to the Remindal database.
+// Client shared by every operation, set by [Connect]
+var client *mongo.Client
+
+// Opens the connection pool to the Remindal database, shared by every operation.
+// Must be called once before any operation, which fails with [ErrUnavailable] otherwise.
 //
-// Should the attempt to establish a connection fail, returns [nil] for the client and [ErrInternalServerError] error.
-func openConnection() (*mongo.Client, error) {
+// Should the client fail to be created, returns [ErrUnavailable] error.
+func Connect(ctx context.Context) error {
 	serverAPI := options.ServerAPI(options.ServerAPIVersion1)
-	opts := options.Client().ApplyURI(mongoURI).SetServerAPIOptions(serverAPI)
+	opts := options.Client().ApplyURI(mongoURI).SetServerAPIOptions(serverAPI).SetConnectTimeout(OpTimeouts.Connect)
 
-	client, err := mongo.Connect(context.Background(), opts)
+	c, err := mongo.Connect(ctx, opts)
 	if err != nil {
-		log.Println("database.OpenConnection - mongo.Connect ", err)
-		return nil, err
+		slog.Error("database.Connect - mongo.Connect", "err", err)
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	client = c
+	return nil
+}
+
+// Closes the connection pool to the Remindal database, waiting for the operations in
+// progress until the context is done. Operations started afterwards fail with [ErrUnavailable].
+func Disconnect(ctx context.Context) error {
+	if client == nil {
+		return nil
+	}
+	return client.Disconnect(ctx)
+}
+
+// Returns the named collection of the Remindal database
+func collection(name string) (*mongo.Collection, error) {
+	if client == nil {
+		return nil, ErrUnavailable
+	}
+	return client.Database(DB_NAME).Collection(name), nil
+}
+
+// Checks that the primary of the Remindal database can be reached before the context is done.
+//
+// [ErrUnavailable]: If the database cannot be reached.
+// [ErrTimeout]: If the primary does not answer in time.
+func Ping(ctx context.Context) error {
+	if client == nil {
+		return ErrUnavailable
 	}
-	return client, nil
+	return classify(client.Ping(ctx, readpref.Primary()))
 }
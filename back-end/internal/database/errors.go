@@ -0,0 +1,89 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// Errors returned by the database operations. The error from the driver is wrapped
+// along with them, so they must be checked with [errors.Is].
+var (
+	ErrNotFound    = errors.New("no document found")
+	ErrConflict    = errors.New("document already present")
+	ErrUnavailable = errors.New("database unavailable")
+	ErrTimeout     = errors.New("database operation timed out")
+	ErrCanceled    = errors.New("database operation canceled")
+	ErrTooMany     = errors.New("too many documents to scan")
+)
+
+// Classifies an error returned by the mongo driver as one of the package errors.
+// Errors that do not fit any of them are returned untouched.
+func classify(err error) error {
+	var sse topology.ServerSelectionError
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	case mongo.IsDuplicateKeyError(err):
+		return fmt.Errorf("%w: %w", ErrConflict, err)
+	// checked first, the driver reports the operations canceled by the caller as
+	// network errors too
+	case errors.Is(err, context.Canceled):
+		return fmt.Errorf("%w: %w", ErrCanceled, err)
+	case mongo.IsTimeout(err), errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	case errors.As(err, &sse), mongo.IsNetworkError(err), errors.Is(err, mongo.ErrClientDisconnected):
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	return err
+}
+
+// Codes of the errors of the backends that do not support a command, an operator or
+// an index, such as the MongoDB compatible databases lacking full-text search or some
+// aggregation stages
+var unsupportedCodes = []int{
+	27,    // IndexNotFound, e.g. no text index for a $text query
+	67,    // CannotCreateIndex
+	115,   // CommandNotSupported
+	238,   // NotImplemented
+	168,   // InvalidPipelineOperator
+	40324, // unrecognized pipeline stage, e.g. $facet
+}
+
+// Reports whether the error tells that the backend does not support the operation
+func unsupported(err error) bool {
+	var se mongo.ServerError
+	if !errors.As(err, &se) {
+		return false
+	}
+	for _, code := range unsupportedCodes {
+		if se.HasErrorCode(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a short name of the kind of error, among the package errors
+func errorKind(err error) string {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return "not_found"
+	case errors.Is(err, ErrConflict):
+		return "conflict"
+	case errors.Is(err, ErrUnavailable):
+		return "unavailable"
+	case errors.Is(err, ErrTimeout):
+		return "timeout"
+	case errors.Is(err, ErrCanceled):
+		return "canceled"
+	case errors.Is(err, ErrTooMany):
+		return "too_many"
+	}
+	return "other"
+}
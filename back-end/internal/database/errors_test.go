@@ -0,0 +1,37 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err  error
+		want error
+		kind string
+	}{
+		{mongo.ErrNoDocuments, ErrNotFound, "not_found"},
+		{context.DeadlineExceeded, ErrTimeout, "timeout"},
+		{context.Canceled, ErrCanceled, "canceled"},
+		{fmt.Errorf("reading the reply: %w", context.Canceled), ErrCanceled, "canceled"},
+		{mongo.ErrClientDisconnected, ErrUnavailable, "unavailable"},
+	}
+	for _, tt := range tests {
+		err := classify(tt.err)
+		if !errors.Is(err, tt.want) || !errors.Is(err, tt.err) {
+			t.Errorf("classify(%v) = %v, want it to wrap %v", tt.err, err, tt.want)
+		}
+		if kind := errorKind(err); kind != tt.kind {
+			t.Errorf("errorKind(%v) = %q, want %q", err, kind, tt.kind)
+		}
+	}
+	other := errors.New("other")
+	if err := classify(other); err != other || errorKind(err) != "other" {
+		t.Errorf("classify(other) = %v, want it untouched", err)
+	}
+}
@@ -0,0 +1,151 @@
+package database
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Text index used by the full-text search over dates. Labels weigh more than the
+// type, which weighs more than the free text description.
+var calendarTextIndex = mongo.IndexModel{
+	Keys: bson.D{
+		{Key: "description", Value: "text"},
+		{Key: "labels", Value: "text"},
+		{Key: "type", Value: "text"},
+	},
+	Options: options.Index().
+		SetName("calendar_text").
+		SetWeights(calendarTextWeights).
+		// dates are written in any language, "none" disables stemming and stop words
+		// while keeping the case and diacritic insensitive tokenization
+		SetDefaultLanguage("none"),
+}
+
+// Expires the sessions once they are past their expiration time
+var sessionTTLIndex = mongo.IndexModel{
+	Keys:    bson.D{{Key: "expireAt", Value: 1}},
+	Options: options.Index().SetName("sessions_ttl").SetExpireAfterSeconds(0),
+}
+
+// Expires the single use tokens sent by email once they are past their expiration time
+var tokenTTLIndex = mongo.IndexModel{
+	Keys:    bson.D{{Key: "expireAt", Value: 1}},
+	Options: options.Index().SetName("tokens_ttl").SetExpireAfterSeconds(0),
+}
+
+// Expires the API keys created with an expiration time, the others never expire
+var apiKeyTTLIndex = mongo.IndexModel{
+	Keys:    bson.D{{Key: "expireAt", Value: 1}},
+	Options: options.Index().SetName("apikeys_ttl").SetExpireAfterSeconds(0),
+}
+
+// Lists the API keys of a user
+var apiKeyUserIndex = mongo.IndexModel{
+	Keys:    bson.D{{Key: "user", Value: 1}, {Key: "prefix", Value: 1}},
+	Options: options.Index().SetName("apikeys_user"),
+}
+
+// Finds the user linked to an account of the OpenID Connect provider. Unique, so
+// that an account cannot be linked to two users.
+var userOIDCIndex = mongo.IndexModel{
+	Keys:    bson.D{{Key: "oidcSubject", Value: 1}},
+	Options: options.Index().SetName("users_oidc").SetUnique(true).SetSparse(true),
+}
+
+// Lists the audit trail of a user, newest first
+var auditUserIndex = mongo.IndexModel{
+	Keys:    bson.D{{Key: "user", Value: 1}, {Key: "at", Value: -1}},
+	Options: options.Index().SetName("audit_user"),
+}
+
+// Finds the accounts whose deletion is due
+var userDeleteIndex = mongo.IndexModel{
+	Keys:    bson.D{{Key: "deleteAt", Value: 1}},
+	Options: options.Index().SetName("users_delete").SetSparse(true),
+}
+
+// Expires the exports of personal data once their download link is past its expiration time
+var exportTTLIndex = mongo.IndexModel{
+	Keys:    bson.D{{Key: "expireAt", Value: 1}},
+	Options: options.Index().SetName("exports_ttl").SetExpireAfterSeconds(0),
+}
+
+// Lists the exports of a user
+var exportUserIndex = mongo.IndexModel{
+	Keys:    bson.D{{Key: "user", Value: 1}, {Key: "createdAt", Value: -1}},
+	Options: options.Index().SetName("exports_user"),
+}
+
+// Set once every index the application relies on has been created
+var indexesEnsured atomic.Bool
+
+// Reports whether [EnsureIndexes] succeeded since the process started
+func IndexesEnsured() bool {
+	return indexesEnsured.Load()
+}
+
+// Indexes the application relies on, along with their collection
+var indexes = []struct {
+	collection string
+	model      mongo.IndexModel
+	// set instead of failing when the backend does not support the index, for the
+	// indexes the application can do without
+	unsupported *atomic.Bool
+}{
+	{CALENDAR_COLLECTION, calendarTextIndex, &textIndexUnsupported},
+	{RATELIMIT_COLLECTION, rateLimitTTLIndex, nil},
+	{SESSION_COLLECTION, sessionTTLIndex, nil},
+	{TOKEN_COLLECTION, tokenTTLIndex, nil},
+	{APIKEY_COLLECTION, apiKeyTTLIndex, nil},
+	{APIKEY_COLLECTION, apiKeyUserIndex, nil},
+	{USER_COLLECTION, userOIDCIndex, nil},
+	{USER_COLLECTION, userDeleteIndex, nil},
+	{AUDIT_COLLECTION, auditUserIndex, nil},
+	{EXPORT_COLLECTION, exportTTLIndex, nil},
+	{EXPORT_COLLECTION, exportUserIndex, nil},
+}
+
+// Creates the indexes the application relies on. The text index is skipped on backends
+// that do not support it, searches then use an inverted index instead.
+// Creating an index that already exists with the same options is a no operation.
+//
+// [ErrUnavailable]: If the database cannot be reached.
+// [ErrTimeout]: If the creation does not complete in time.
+func EnsureIndexes(ctx context.Context) error {
+	for _, i := range indexes {
+		err := createIndex(ctx, i.collection, i.model)
+		if err != nil && i.unsupported != nil && unsupported(err) {
+			slog.Warn("database.EnsureIndexes - index not supported by the backend", "collection", i.collection, "err", err)
+			i.unsupported.Store(true)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	indexesEnsured.Store(true)
+	return nil
+}
+
+func createIndex(ctx context.Context, collectionName string, model mongo.IndexModel) (err error) {
+	ctx, done := observe(ctx, "createIndex", collectionName, nil)
+	defer done(&err)
+
+	ctx, cancel := context.WithTimeout(ctx, OpTimeouts.Write)
+	defer cancel()
+
+	coll, err := collection(collectionName)
+	if err != nil {
+		return err
+	}
+	_, err = coll.Indexes().CreateOne(ctx, model)
+	if err != nil {
+		return classify(err)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"remindal/internal/logging"
+	"remindal/internal/metrics"
+	"remindal/internal/tracing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Starts observing a database operation, within a span child of the one of the context.
+// The filter, if any, is recorded on the span by its shape only. The returned context
+// carries the span and must be used by the operation. The returned function must be
+// deferred with a pointer to the error returned by the operation, it ends the span,
+// records the latency and errors of the operation and logs its outcome with the logger
+// of the context.
+func observe(ctx context.Context, op string, collectionName string, filter any) (context.Context, func(*error)) {
+	attrs := []attribute.KeyValue{
+		semconv.DBSystemMongoDB,
+		semconv.DBName(DB_NAME),
+		semconv.DBMongoDBCollection(collectionName),
+		semconv.DBOperation(op),
+	}
+	if filter != nil {
+		attrs = append(attrs, semconv.DBStatement(filterShape(filter)))
+	}
+	ctx, span := tracing.Tracer().Start(ctx, op+" "+DB_NAME+"."+collectionName,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+
+	start := time.Now()
+	return ctx, func(errp *error) {
+		defer span.End()
+		elapsed := time.Since(start)
+		metrics.DbDuration.WithLabelValues(op, collectionName).Observe(elapsed.Seconds())
+
+		logger := logging.FromContext(ctx)
+		attrs := []any{
+			"op", op,
+			"collection", collectionName,
+			"latency_ms", float64(elapsed.Microseconds()) / 1000,
+		}
+		if err := *errp; err != nil {
+			kind := errorKind(err)
+			metrics.DbErrors.WithLabelValues(op, collectionName, kind).Inc()
+			span.SetAttributes(attribute.String("error.type", kind))
+			// the caller giving up, e.g. the client went away, is not a failure of the database
+			if errors.Is(err, ErrCanceled) {
+				logger.Debug("database operation canceled", append(attrs, "err", err)...)
+				return
+			}
+			// a missing document is an expected outcome rather than a failure of the operation
+			if errors.Is(err, ErrNotFound) {
+				logger.Debug("database operation found nothing", append(attrs, "err", err)...)
+				return
+			}
+			tracing.Fail(span, err)
+			logger.Warn("database operation failed", append(attrs, "err", err)...)
+			return
+		}
+		logger.Debug("database operation", attrs...)
+	}
+}
@@ -8,93 +8,333 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// Opens a connection to the database and retrieves an array of items that match the provided query.
+// Retrieves an array of items that match the provided query.
 // Fetches multiple documents based on the specified query filter and unmarshals the results into the provided destination.
+// Full-text searches fall back to an inverted index on backends without text indexes.
 //
-// [ErrInternalServerError]: If a connection to the database cannot be established or if the retrieval operation fails.
-// [ErrNoDocumentsFound]: If no documents match the query.
-func GetMany(collectionName string, query bson.D, sort bson.D, dest any) error {
-	client, err := openConnection()
+// [ErrUnavailable]: If the database cannot be reached.
+// [ErrTimeout]: If the retrieval operation does not complete in time.
+// [ErrTooMany]: If a search falling back to the inverted index has too many documents to go through.
+func GetMany(ctx context.Context, collectionName string, query bson.D, sort bson.D, dest any) (err error) {
+	ctx, done := observe(ctx, "find", collectionName, query)
+	defer done(&err)
+
+	ctx, cancel := context.WithTimeout(ctx, OpTimeouts.Read)
+	defer cancel()
+
+	opts := options.Find().SetSort(sort)
+	coll, err := collection(collectionName)
 	if err != nil {
 		return err
 	}
-	defer closeConnection(client)
+	search, rest, isSearch := splitTextSearch(query)
+	if isSearch && textIndexUnsupported.Load() {
+		return searchWithoutIndex(ctx, coll, search, rest, sort, dest)
+	}
+	cursor, err := coll.Find(ctx, query, opts)
+	// e.g. the text index is not created yet
+	if isSearch && unsupported(err) {
+		return searchWithoutIndex(ctx, coll, search, rest, sort, dest)
+	}
+	if err != nil {
+		return classify(err)
+	}
+	if err := cursor.All(ctx, dest); err != nil {
+		return classify(err)
+	}
+	return nil
+}
 
-	opts := options.Find().SetSort(sort)
-	coll := client.Database(DB_NAME).Collection(collectionName)
-	cursor, err := coll.Find(context.TODO(), query, opts)
+// Hands the documents of the collection matching the query to fn one at a time, as the
+// cursor reads them, instead of loading them all first. The document is only valid
+// during the call. Stops at the first error returned by fn.
+func scan(ctx context.Context, coll *mongo.Collection, query bson.D, opts *options.FindOptions, fn func(bson.Raw) error) error {
+	cursor, err := coll.Find(ctx, query, opts)
 	if err != nil {
-		return err
+		return classify(err)
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		if err := fn(cursor.Current); err != nil {
+			return err
+		}
 	}
-	if err := cursor.All(context.TODO(), dest); err != nil {
+	return classify(cursor.Err())
+}
+
+// Runs the provided aggregation pipeline on the collection.
+// Unmarshals every document produced by the pipeline into the provided destination, which must be a slice.
+//
+// [ErrUnavailable]: If the database cannot be reached.
+// [ErrTimeout]: If the aggregation does not complete in time.
+func Aggregate(ctx context.Context, collectionName string, pipeline mongo.Pipeline, dest any) (err error) {
+	ctx, done := observe(ctx, "aggregate", collectionName, pipeline)
+	defer done(&err)
+
+	ctx, cancel := context.WithTimeout(ctx, OpTimeouts.Aggregate)
+	defer cancel()
+
+	coll, err := collection(collectionName)
+	if err != nil {
 		return err
 	}
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return classify(err)
+	}
+	if err := cursor.All(ctx, dest); err != nil {
+		return classify(err)
+	}
 	return nil
 }
 
-// Opens a connection to the database and retrieves a single document that matches the provided key-value pair.
+// Retrieves a single document that matches the provided key-value pair.
 // Fetches a document based on the specified key and value and unmarshals the result into the provided destination.
 //
-// [ErrInternalServerError]: If a connection to the database cannot be established or if the retrieval operation fails.
-// [ErrNoDocumentsFound]: If no document matches the key-value pair.
-func GetOne(collectionName string, key string, value any, dest any) error {
-	client, err := openConnection()
+// [ErrUnavailable]: If the database cannot be reached.
+// [ErrTimeout]: If the retrieval operation does not complete in time.
+// [ErrNotFound]: If no document matches the key-value pair.
+func GetOne(ctx context.Context, collectionName string, key string, value any, dest any) (err error) {
+	filter := bson.D{{Key: key, Value: value}}
+	ctx, done := observe(ctx, "findOne", collectionName, filter)
+	defer done(&err)
+
+	ctx, cancel := context.WithTimeout(ctx, OpTimeouts.Read)
+	defer cancel()
+
+	coll, err := collection(collectionName)
 	if err != nil {
 		return err
 	}
-	defer closeConnection(client)
-
-	coll := client.Database(DB_NAME).Collection(collectionName)
-	doc := coll.FindOne(context.TODO(), bson.D{{Key: key, Value: value}})
+	doc := coll.FindOne(ctx, filter)
 	err = doc.Decode(dest)
-	if err == nil || err == mongo.ErrNoDocuments {
-		return nil
+	if err != nil {
+		return classify(err)
 	}
-	return err
+	return nil
 }
 
-// Opens a connection to the database and inserts the provided document into the specified collection.
+// Inserts the provided document into the specified collection.
 //
-// [ErrInternalServerError]: If a connection to the database cannot be established.
-// [ErrItemAlreadyPresent]: If there is a collision with the primary key of an existing item in the database.
-func PutOne(collectionName string, doc any) error {
-	client, err := openConnection()
+// [ErrUnavailable]: If the database cannot be reached.
+// [ErrTimeout]: If the insert operation does not complete in time.
+// [ErrConflict]: If there is a collision with the primary key of an existing item in the database.
+func PutOne(ctx context.Context, collectionName string, doc any) (err error) {
+	ctx, done := observe(ctx, "insertOne", collectionName, nil)
+	defer done(&err)
+
+	ctx, cancel := context.WithTimeout(ctx, OpTimeouts.Write)
+	defer cancel()
+
+	coll, err := collection(collectionName)
 	if err != nil {
 		return err
 	}
-	defer closeConnection(client)
+	_, err = coll.InsertOne(ctx, doc)
+	if err != nil {
+		return classify(err)
+	}
+	return nil
+}
+
+// Retrieves the document that matches the provided query and deletes it in a single
+// atomic operation, so that only one caller can ever retrieve it.
+//
+// [ErrUnavailable]: If the database cannot be reached.
+// [ErrTimeout]: If the operation does not complete in time.
+// [ErrNotFound]: If no document matches the query.
+func TakeOne(ctx context.Context, collectionName string, query bson.D, dest any) (err error) {
+	ctx, done := observe(ctx, "findOneAndDelete", collectionName, query)
+	defer done(&err)
+
+	ctx, cancel := context.WithTimeout(ctx, OpTimeouts.Write)
+	defer cancel()
 
-	coll := client.Database(DB_NAME).Collection(collectionName)
-	_, err = coll.InsertOne(context.TODO(), doc)
+	coll, err := collection(collectionName)
 	if err != nil {
 		return err
 	}
+	if err := coll.FindOneAndDelete(ctx, query).Decode(dest); err != nil {
+		return classify(err)
+	}
 	return nil
 }
 
-// Opens a connection to the database and deletes a document that matches the provided key-value pair.
+// Applies the update, made of update operators, to the document that matches the
+// provided query and retrieves the document as it was before the update.
 //
-// [ErrInternalServerError]: If a connection to the database cannot be established or if the delete operation fails.
-// [ErrNoDocumentsFound]: If no document matches the key-value pair.
-func DeleteOne(collectionName string, key string, value any) error {
-	client, err := openConnection()
+// [ErrUnavailable]: If the database cannot be reached.
+// [ErrTimeout]: If the operation does not complete in time.
+// [ErrNotFound]: If no document matches the query.
+func FindOneAndUpdate(ctx context.Context, collectionName string, query bson.D, update bson.D, dest any) (err error) {
+	ctx, done := observe(ctx, "findOneAndUpdate", collectionName, query)
+	defer done(&err)
+
+	ctx, cancel := context.WithTimeout(ctx, OpTimeouts.Write)
+	defer cancel()
+
+	coll, err := collection(collectionName)
 	if err != nil {
 		return err
 	}
-	defer closeConnection(client)
+	if err := coll.FindOneAndUpdate(ctx, query, update).Decode(dest); err != nil {
+		return classify(err)
+	}
+	return nil
+}
+
+// Updates the fields of the document that matches the provided key-value pair,
+// setting them to the values in set.
+//
+// [ErrUnavailable]: If the database cannot be reached.
+// [ErrTimeout]: If the update operation does not complete in time.
+// [ErrNotFound]: If no document matches the key-value pair.
+func UpdateOne(ctx context.Context, collectionName string, key string, value any, set bson.D) error {
+	return UpdateOneMatching(ctx, collectionName, bson.D{{Key: key, Value: value}}, bson.D{{Key: "$set", Value: set}})
+}
+
+// Applies the update, made of update operators, to the document that matches the
+// provided query. Conditions in the query make the update atomic, e.g. it only
+// applies if a field still holds the value read before.
+//
+// [ErrUnavailable]: If the database cannot be reached.
+// [ErrTimeout]: If the update operation does not complete in time.
+// [ErrNotFound]: If no document matches the query.
+func UpdateOneMatching(ctx context.Context, collectionName string, query bson.D, update bson.D) (err error) {
+	ctx, done := observe(ctx, "updateOne", collectionName, query)
+	defer done(&err)
+
+	ctx, cancel := context.WithTimeout(ctx, OpTimeouts.Write)
+	defer cancel()
 
-	coll := client.Database(DB_NAME).Collection(collectionName)
-	res, err := coll.DeleteOne(context.TODO(), bson.D{{Key: key, Value: value}})
+	coll, err := collection(collectionName)
 	if err != nil {
 		return err
 	}
+	res, err := coll.UpdateOne(ctx, query, update)
+	if err != nil {
+		return classify(err)
+	}
+	if res.MatchedCount == 0 {
+		return classify(mongo.ErrNoDocuments)
+	}
+	return nil
+}
+
+// Applies the update, made of update operators, to every document that matches the
+// provided query and returns how many were modified.
+//
+// [ErrUnavailable]: If the database cannot be reached.
+// [ErrTimeout]: If the update operation does not complete in time.
+func UpdateMany(ctx context.Context, collectionName string, query bson.D, update bson.D) (n int64, err error) {
+	ctx, done := observe(ctx, "updateMany", collectionName, query)
+	defer done(&err)
+
+	ctx, cancel := context.WithTimeout(ctx, OpTimeouts.Write)
+	defer cancel()
+
+	coll, err := collection(collectionName)
+	if err != nil {
+		return 0, err
+	}
+	res, err := coll.UpdateMany(ctx, query, update)
+	if err != nil {
+		return 0, classify(err)
+	}
+	return res.ModifiedCount, nil
+}
+
+// Sets the fields of the document that matches the provided key-value pair to the
+// values in set, inserting the document if none matches.
+//
+// [ErrUnavailable]: If the database cannot be reached.
+// [ErrTimeout]: If the update operation does not complete in time.
+func UpsertOne(ctx context.Context, collectionName string, key string, value any, set bson.D) (err error) {
+	query := bson.D{{Key: key, Value: value}}
+	ctx, done := observe(ctx, "updateOne", collectionName, query)
+	defer done(&err)
+
+	ctx, cancel := context.WithTimeout(ctx, OpTimeouts.Write)
+	defer cancel()
+
+	coll, err := collection(collectionName)
+	if err != nil {
+		return err
+	}
+	_, err = coll.UpdateOne(ctx, query, bson.D{{Key: "$set", Value: set}}, options.Update().SetUpsert(true))
+	if err != nil {
+		return classify(err)
+	}
+	return nil
+}
+
+// Deletes a document that matches the provided key-value pair.
+//
+// [ErrUnavailable]: If the database cannot be reached.
+// [ErrTimeout]: If the delete operation does not complete in time.
+// [ErrNotFound]: If no document matches the key-value pair.
+func DeleteOne(ctx context.Context, collectionName string, key string, value any) error {
+	return DeleteOneMatching(ctx, collectionName, bson.D{{Key: key, Value: value}})
+}
+
+// Deletes a document that matches the provided query.
+//
+// [ErrUnavailable]: If the database cannot be reached.
+// [ErrTimeout]: If the delete operation does not complete in time.
+// [ErrNotFound]: If no document matches the query.
+func DeleteOneMatching(ctx context.Context, collectionName string, query bson.D) (err error) {
+	ctx, done := observe(ctx, "deleteOne", collectionName, query)
+	defer done(&err)
+
+	ctx, cancel := context.WithTimeout(ctx, OpTimeouts.Write)
+	defer cancel()
+
+	coll, err := collection(collectionName)
+	if err != nil {
+		return err
+	}
+	res, err := coll.DeleteOne(ctx, query)
+	if err != nil {
+		return classify(err)
+	}
 	if res.DeletedCount == 0 {
-		return mongo.ErrNoDocuments
+		return classify(mongo.ErrNoDocuments)
 	}
 	return nil
 }
 
+// Deletes every document that matches the provided query and returns how many were deleted.
+//
+// [ErrUnavailable]: If the database cannot be reached.
+// [ErrTimeout]: If the delete operation does not complete in time.
+func DeleteMany(ctx context.Context, collectionName string, query bson.D) (n int64, err error) {
+	ctx, done := observe(ctx, "deleteMany", collectionName, query)
+	defer done(&err)
+
+	ctx, cancel := context.WithTimeout(ctx, OpTimeouts.Write)
+	defer cancel()
+
+	coll, err := collection(collectionName)
+	if err != nil {
+		return 0, err
+	}
+	res, err := coll.DeleteMany(ctx, query)
+	if err != nil {
+		return 0, classify(err)
+	}
+	return res.DeletedCount, nil
+}
+
 // creates a sort document to correctly sort a mongoDB resul
 func CreateSort(k string, v int) bson.D {
 	return bson.D{{Key: k, Value: v}}
 }
+
+// creates a sort document that orders a mongoDB result by full-text search relevance,
+// breaking ties with the given key
+func CreateTextScoreSort(k string, v int) bson.D {
+	return bson.D{
+		{Key: "score", Value: bson.D{{Key: "$meta", Value: "textScore"}}},
+		{Key: k, Value: v},
+	}
+}
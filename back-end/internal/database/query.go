@@ -2,6 +2,7 @@ package database
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -31,7 +32,13 @@ func (qb *QueryBuilder) AddMultiSelectField(k string, v string, sep string) {
 	for _, item := range vals {
 		ms = append(ms, bson.D{{Key: k, Value: item}})
 	}
-	qb.query = append(qb.query, bson.E{Key: "$or", Value: ms})
+	qb.addAlternatives(ms)
+}
+
+// Adds a full-text search filter to the query document. Requires the collection
+// to have a text index, see [EnsureIndexes]
+func (qb *QueryBuilder) AddTextSearch(v string) {
+	qb.query = append(qb.query, bson.E{Key: "$text", Value: bson.D{{Key: "$search", Value: v}}})
 }
 
 // Converts the value and adds a simple field filter to the query document
@@ -39,7 +46,7 @@ func (qb *QueryBuilder) AddMultiSelectField(k string, v string, sep string) {
 func (qb *QueryBuilder) AddFieldCnv(k string, v string, cnv func(s string) (any, error)) {
 	val, err := cnv(v)
 	if err != nil {
-		qb.err = errors.Join(err)
+		qb.err = errors.Join(qb.err, err)
 		return
 	}
 	qb.query = append(qb.query, bson.E{Key: k, Value: val})
@@ -53,12 +60,12 @@ func (qb *QueryBuilder) AddMultiSelectCnv(k string, v string, sep string, cnv fu
 	for _, item := range vals {
 		val, err := cnv(item)
 		if err != nil {
-			qb.err = errors.Join(err)
+			qb.err = errors.Join(qb.err, err)
 			return
 		}
 		ms = append(ms, bson.D{{Key: k, Value: val}})
 	}
-	qb.query = append(qb.query, bson.E{Key: "$or", Value: ms})
+	qb.addAlternatives(ms)
 }
 
 // Converts the value and adds a range filter to the query document
@@ -66,7 +73,7 @@ func (qb *QueryBuilder) AddMultiSelectCnv(k string, v string, sep string, cnv fu
 func (qb *QueryBuilder) AddRangeField(k string, v string, min bool, cnv func(s string) (any, error)) {
 	val, err := cnv(v)
 	if err != nil {
-		qb.err = errors.Join(err)
+		qb.err = errors.Join(qb.err, err)
 		return
 	}
 
@@ -76,6 +83,13 @@ func (qb *QueryBuilder) AddRangeField(k string, v string, min bool, cnv func(s s
 	} else {
 		cond = "$lte"
 	}
+	// both bounds go under the same key, a document with repeated keys is ambiguous
+	if i := qb.index(k); i >= 0 {
+		if ops, ok := qb.query[i].Value.(bson.D); ok {
+			qb.query[i].Value = append(ops, bson.E{Key: cond, Value: val})
+			return
+		}
+	}
 	r := bson.E{
 		Key:   k,
 		Value: bson.D{{Key: cond, Value: val}},
@@ -83,7 +97,40 @@ func (qb *QueryBuilder) AddRangeField(k string, v string, min bool, cnv func(s s
 	qb.query = append(qb.query, r)
 }
 
-// Returns the error in the QueryBuilder
+// Adds the alternatives of a multi select filter to the query document. Every multi
+// select filter is an $or within a single $and, a document with repeated $or keys is
+// ambiguous.
+func (qb *QueryBuilder) addAlternatives(alts bson.A) {
+	or := bson.D{{Key: "$or", Value: alts}}
+	if i := qb.index("$and"); i >= 0 {
+		and, ok := qb.query[i].Value.(bson.A)
+		if !ok {
+			qb.err = errors.Join(qb.err, fmt.Errorf("$and holds %T instead of an array", qb.query[i].Value))
+			return
+		}
+		qb.query[i].Value = append(and, or)
+		return
+	}
+	qb.query = append(qb.query, bson.E{Key: "$and", Value: bson.A{or}})
+}
+
+// Returns the position of the key in the query document, -1 if it is not there
+func (qb *QueryBuilder) index(k string) int {
+	for i, e := range qb.query {
+		if e.Key == k {
+			return i
+		}
+	}
+	return -1
+}
+
+// Adds an error to the QueryBuilder, used to report problems found while
+// validating the input before any filter is added
+func (qb *QueryBuilder) AddErr(err error) {
+	qb.err = errors.Join(qb.err, err)
+}
+
+// Returns all the errors collected by the QueryBuilder joined together
 func (qb *QueryBuilder) Err() error {
 	return qb.err
 }
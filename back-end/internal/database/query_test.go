@@ -0,0 +1,22 @@
+package database
+
+import "testing"
+
+func TestAddAlternativesNonArrayAnd(t *testing.T) {
+	qb := NewQueryBuilder()
+	qb.AddField("$and", "x")
+	qb.AddMultiSelectField("color", "red,blue", ",")
+	if qb.Err() == nil {
+		t.Fatal("want an error for a $and that is not an array")
+	}
+
+	qb = NewQueryBuilder()
+	qb.AddMultiSelectField("color", "red,blue", ",")
+	qb.AddMultiSelectField("size", "s,m", ",")
+	if err := qb.Err(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := len(qb.Query()); got != 1 {
+		t.Fatalf("query has %d top-level fields, want the alternatives in one $and", got)
+	}
+}
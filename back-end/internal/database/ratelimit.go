@@ -0,0 +1,149 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var RATELIMIT_COLLECTION = "ratelimits"
+
+// Expires the rate limiting counters once they are no longer needed
+var rateLimitTTLIndex = mongo.IndexModel{
+	Keys:    bson.D{{Key: "expireAt", Value: 1}},
+	Options: options.Index().SetName("ratelimits_ttl").SetExpireAfterSeconds(0),
+}
+
+// Token bucket stored by [TakeToken]
+type TokenBucket struct {
+	Tokens  float64 `bson:"tokens"`
+	Allowed bool    `bson:"allowed"`
+}
+
+// Failures counter stored by [RecordFailure] and [LockKey]
+type FailureCounter struct {
+	Failures    int       `bson:"failures"`
+	LockedUntil time.Time `bson:"lockedUntil"`
+}
+
+// Refills the bucket of the key with rate tokens per second up to burst, then takes
+// a token from it if one is available, in a single atomic update. The bucket is
+// created full and expires once it would be full again.
+//
+// [ErrUnavailable]: If the database cannot be reached.
+// [ErrTimeout]: If the update does not complete in time.
+func TakeToken(ctx context.Context, key string, burst int, rate float64, now time.Time) (b TokenBucket, err error) {
+	filter := bson.D{{Key: "_id", Value: key}}
+	ctx, done := observe(ctx, "takeToken", RATELIMIT_COLLECTION, filter)
+	defer done(&err)
+
+	ctx, cancel := context.WithTimeout(ctx, OpTimeouts.Write)
+	defer cancel()
+
+	coll, err := collection(RATELIMIT_COLLECTION)
+	if err != nil {
+		return b, err
+	}
+	elapsed := bson.D{{Key: "$divide", Value: bson.A{
+		bson.D{{Key: "$subtract", Value: bson.A{now, bson.D{{Key: "$ifNull", Value: bson.A{"$at", now}}}}}},
+		1000,
+	}}}
+	refilled := bson.D{{Key: "$min", Value: bson.A{
+		burst,
+		bson.D{{Key: "$add", Value: bson.A{
+			bson.D{{Key: "$ifNull", Value: bson.A{"$tokens", burst}}},
+			bson.D{{Key: "$multiply", Value: bson.A{elapsed, rate}}},
+		}}},
+	}}}
+	fullIn := time.Duration(float64(burst) / rate * float64(time.Second))
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{{Key: "tokens", Value: refilled}, {Key: "at", Value: now}}}},
+		{{Key: "$set", Value: bson.D{{Key: "allowed", Value: bson.D{{Key: "$gte", Value: bson.A{"$tokens", 1}}}}}}},
+		{{Key: "$set", Value: bson.D{
+			{Key: "tokens", Value: bson.D{{Key: "$cond", Value: bson.A{"$allowed", bson.D{{Key: "$subtract", Value: bson.A{"$tokens", 1}}}, "$tokens"}}}},
+			{Key: "expireAt", Value: now.Add(fullIn)},
+		}}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	if err := coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&b); err != nil {
+		return b, classify(err)
+	}
+	return b, nil
+}
+
+// Increments the failures of the key, starting over if the last one happened more
+// than memory ago, and returns the updated counter.
+//
+// [ErrUnavailable]: If the database cannot be reached.
+// [ErrTimeout]: If the update does not complete in time.
+func RecordFailure(ctx context.Context, key string, now time.Time, memory time.Duration) (c FailureCounter, err error) {
+	filter := bson.D{{Key: "_id", Value: key}}
+	ctx, done := observe(ctx, "recordFailure", RATELIMIT_COLLECTION, filter)
+	defer done(&err)
+
+	ctx, cancel := context.WithTimeout(ctx, OpTimeouts.Write)
+	defer cancel()
+
+	coll, err := collection(RATELIMIT_COLLECTION)
+	if err != nil {
+		return c, err
+	}
+	forgotten := bson.D{{Key: "$lt", Value: bson.A{
+		bson.D{{Key: "$ifNull", Value: bson.A{"$last", time.Time{}}}},
+		now.Add(-memory),
+	}}}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{
+			{Key: "failures", Value: bson.D{{Key: "$cond", Value: bson.A{
+				forgotten,
+				1,
+				bson.D{{Key: "$add", Value: bson.A{"$failures", 1}}},
+			}}}},
+			{Key: "last", Value: now},
+			{Key: "expireAt", Value: bson.D{{Key: "$max", Value: bson.A{now.Add(memory), "$lockedUntil"}}}},
+		}}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	if err := coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&c); err != nil {
+		return c, classify(err)
+	}
+	return c, nil
+}
+
+// Locks the key until the given time, keeping its counter at least as long.
+//
+// [ErrUnavailable]: If the database cannot be reached.
+// [ErrTimeout]: If the update does not complete in time.
+func LockKey(ctx context.Context, key string, until time.Time) (err error) {
+	filter := bson.D{{Key: "_id", Value: key}}
+	ctx, done := observe(ctx, "lockKey", RATELIMIT_COLLECTION, filter)
+	defer done(&err)
+
+	ctx, cancel := context.WithTimeout(ctx, OpTimeouts.Write)
+	defer cancel()
+
+	coll, err := collection(RATELIMIT_COLLECTION)
+	if err != nil {
+		return err
+	}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "lockedUntil", Value: until}}},
+		{Key: "$max", Value: bson.D{{Key: "expireAt", Value: until}}},
+	}
+	_, err = coll.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	return classify(err)
+}
+
+// Retrieves the failures counter of the key.
+//
+// [ErrUnavailable]: If the database cannot be reached.
+// [ErrTimeout]: If the retrieval does not complete in time.
+// [ErrNotFound]: If the key has no counter.
+func GetFailures(ctx context.Context, key string) (FailureCounter, error) {
+	var c FailureCounter
+	err := GetOne(ctx, RATELIMIT_COLLECTION, "_id", key, &c)
+	return c, err
+}
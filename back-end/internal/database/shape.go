@@ -0,0 +1,78 @@
+package database
+
+import (
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Placeholder of the values in the shape of a filter
+const SHAPE_VALUE = "?"
+
+// Describes the structure of a filter or pipeline, keys and operators included, with
+// every value replaced by a placeholder, so that it can be recorded without leaking
+// the data being queried. The elements of an array are only described once per shape.
+func filterShape(v any) string {
+	var b strings.Builder
+	writeShape(&b, v)
+	return b.String()
+}
+
+func writeShape(b *strings.Builder, v any) {
+	switch t := v.(type) {
+	case bson.D:
+		b.WriteByte('{')
+		for i, e := range t {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(`"` + e.Key + `":`)
+			writeShape(b, e.Value)
+		}
+		b.WriteByte('}')
+	case bson.M:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		d := make(bson.D, 0, len(t))
+		for _, k := range keys {
+			d = append(d, bson.E{Key: k, Value: t[k]})
+		}
+		writeShape(b, d)
+	case bson.A:
+		writeArrayShape(b, t)
+	case []any:
+		writeArrayShape(b, t)
+	case mongo.Pipeline:
+		stages := make([]any, 0, len(t))
+		for _, s := range t {
+			stages = append(stages, s)
+		}
+		writeArrayShape(b, stages)
+	case []bson.D:
+		writeShape(b, mongo.Pipeline(t))
+	default:
+		b.WriteString(`"` + SHAPE_VALUE + `"`)
+	}
+}
+
+func writeArrayShape(b *strings.Builder, a []any) {
+	seen := map[string]bool{}
+	b.WriteByte('[')
+	for _, e := range a {
+		s := filterShape(e)
+		if seen[s] {
+			continue
+		}
+		if len(seen) > 0 {
+			b.WriteByte(',')
+		}
+		seen[s] = true
+		b.WriteString(s)
+	}
+	b.WriteByte(']')
+}
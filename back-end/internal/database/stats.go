@@ -0,0 +1,314 @@
+package database
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Names of the ISO weekdays, starting from monday
+var isoWeekdays = bson.A{"Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday", "Sunday"}
+
+// Expression building the point in time of a stored date, hours and minutes default to 0
+var dateExpr = bson.D{{Key: "$dateFromParts", Value: bson.D{
+	{Key: "year", Value: "$year"},
+	{Key: "month", Value: "$month"},
+	{Key: "day", Value: "$day"},
+	{Key: "hour", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$hours", 0}}}},
+	{Key: "minute", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$minutes", 0}}}},
+}}}
+
+// $dateFromParts only accepts years between 1 and 9999, dates outside the range are skipped
+// by the stages that need a point in time
+var representableYear = bson.D{{Key: "$match", Value: bson.D{
+	{Key: "year", Value: bson.D{{Key: "$gte", Value: 1}, {Key: "$lte", Value: 9999}}},
+}}}
+
+// Counts the documents for each value of the given expression, most frequent first
+func countBy(expr any) []bson.D {
+	return []bson.D{
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: expr},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+	}
+}
+
+// Counts the documents for each year and month, chronologically
+var countByMonth = []bson.D{
+	{{Key: "$group", Value: bson.D{
+		{Key: "_id", Value: bson.D{{Key: "year", Value: "$year"}, {Key: "month", Value: "$month"}}},
+		{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+	}}},
+	{{Key: "$project", Value: bson.D{
+		{Key: "_id", Value: 0},
+		{Key: "year", Value: "$_id.year"},
+		{Key: "month", Value: "$_id.month"},
+		{Key: "count", Value: 1},
+	}}},
+	{{Key: "$sort", Value: bson.D{{Key: "year", Value: 1}, {Key: "month", Value: 1}}}},
+}
+
+// Builds the aggregation pipeline computing the statistics of the calendar documents
+// matching the query. Produces a single document with:
+//
+//   - byType, byLabel and byWeekday: lists of {_id, count}
+//   - byMonth: list of {year, month, count}
+//   - busiestMonth: the {year, month, count} with the most dates, missing if there are none
+//   - nextPerType: for each type the first date from now on, chronologically
+func DateStatsPipeline(query bson.D, now time.Time) mongo.Pipeline {
+	byWeekday := append([]bson.D{representableYear}, countBy(bson.D{{Key: "$arrayElemAt", Value: bson.A{
+		isoWeekdays,
+		bson.D{{Key: "$subtract", Value: bson.A{bson.D{{Key: "$isoDayOfWeek", Value: dateExpr}}, 1}}},
+	}}})...)
+
+	busiestMonth := append(append([]bson.D{}, countByMonth[:2]...),
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "year", Value: 1}, {Key: "month", Value: 1}}}},
+		bson.D{{Key: "$limit", Value: 1}},
+	)
+
+	nextPerType := []bson.D{
+		representableYear,
+		{{Key: "$addFields", Value: bson.D{{Key: "when", Value: dateExpr}}}},
+		{{Key: "$match", Value: bson.D{{Key: "when", Value: bson.D{{Key: "$gte", Value: now}}}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "when", Value: 1}}}},
+		{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$type"}, {Key: "next", Value: bson.D{{Key: "$first", Value: "$$ROOT"}}}}}},
+		{{Key: "$replaceRoot", Value: bson.D{{Key: "newRoot", Value: "$next"}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "when", Value: 1}}}},
+	}
+
+	return mongo.Pipeline{
+		{{Key: "$match", Value: query}},
+		{{Key: "$facet", Value: bson.D{
+			{Key: "byType", Value: countBy("$type")},
+			{Key: "byLabel", Value: append([]bson.D{{{Key: "$unwind", Value: "$labels"}}}, countBy("$labels")...)},
+			{Key: "byMonth", Value: countByMonth},
+			{Key: "byWeekday", Value: byWeekday},
+			{Key: "busiestMonth", Value: busiestMonth},
+			{Key: "nextPerType", Value: nextPerType},
+		}}},
+		{{Key: "$addFields", Value: bson.D{
+			{Key: "busiestMonth", Value: bson.D{{Key: "$arrayElemAt", Value: bson.A{"$busiestMonth", 0}}}},
+		}}},
+	}
+}
+
+// Set once the backend refused the statistics pipeline, e.g. a MongoDB compatible
+// database without $facet. The statistics are then computed from the documents.
+var aggregationUnsupported atomic.Bool
+
+// Computes the statistics of the calendar documents matching the query, as described
+// by [DateStatsPipeline], and unmarshals them into dest. On backends that do not
+// support the pipeline, the matching documents are streamed and counted here instead.
+//
+// [ErrUnavailable]: If the database cannot be reached.
+// [ErrTimeout]: If the computation does not complete in time.
+func GetDateStats(ctx context.Context, query bson.D, now time.Time, dest any) error {
+	if !aggregationUnsupported.Load() {
+		var stats []bson.Raw
+		err := Aggregate(ctx, CALENDAR_COLLECTION, DateStatsPipeline(query, now), &stats)
+		if err == nil {
+			if len(stats) == 0 {
+				return nil
+			}
+			return bson.Unmarshal(stats[0], dest)
+		}
+		if !unsupported(err) {
+			return err
+		}
+		// a search without text index is answered by GetMany, the pipeline may still work
+		if _, _, isSearch := splitTextSearch(query); !isSearch {
+			slog.Warn("database.GetDateStats - aggregation not supported by the backend", "err", err)
+			aggregationUnsupported.Store(true)
+		}
+	}
+
+	counter := newStatsCounter(now)
+	if err := eachDate(ctx, query, counter.add); err != nil {
+		return err
+	}
+	raw, err := bson.Marshal(counter.stats())
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, dest)
+}
+
+// Hands the calendar documents matching the query to fn one at a time. Searches go
+// through [GetMany], which falls back to a bounded scan on backends without text index,
+// the other queries are streamed from the cursor.
+func eachDate(ctx context.Context, query bson.D, fn func(bson.Raw)) (err error) {
+	if _, _, isSearch := splitTextSearch(query); isSearch {
+		var docs []bson.Raw
+		if err := GetMany(ctx, CALENDAR_COLLECTION, query, CreateSort("_id", 1), &docs); err != nil {
+			return err
+		}
+		for _, d := range docs {
+			fn(d)
+		}
+		return nil
+	}
+
+	ctx, done := observe(ctx, "find", CALENDAR_COLLECTION, query)
+	defer done(&err)
+
+	ctx, cancel := context.WithTimeout(ctx, OpTimeouts.Aggregate)
+	defer cancel()
+
+	coll, err := collection(CALENDAR_COLLECTION)
+	if err != nil {
+		return err
+	}
+	return scan(ctx, coll, query, options.Find().SetSort(CreateSort("_id", 1)), func(raw bson.Raw) error {
+		fn(raw)
+		return nil
+	})
+}
+
+// Fields of a calendar document the statistics are computed from
+type statsDate struct {
+	Type    string   `bson:"type"`
+	Labels  []string `bson:"labels"`
+	Year    int      `bson:"year"`
+	Month   int      `bson:"month"`
+	Day     int      `bson:"day"`
+	Hours   int      `bson:"hours"`
+	Minutes int      `bson:"minutes"`
+}
+
+// Number of documents sharing a key, in the shape produced by [countBy]
+type keyCount struct {
+	Key   string `bson:"_id"`
+	Count int    `bson:"count"`
+}
+
+// Number of documents in a month of a year, in the shape produced by countByMonth
+type monthCount struct {
+	Year  int `bson:"year"`
+	Month int `bson:"month"`
+	Count int `bson:"count"`
+}
+
+// Returns the counts of the keys, most frequent first
+func sortedCounts(counts map[string]int) []keyCount {
+	out := make([]keyCount, 0, len(counts))
+	for k, n := range counts {
+		out = append(out, keyCount{Key: k, Count: n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
+
+// Statistics of calendar documents counted one document at a time, the way
+// [DateStatsPipeline] computes them
+type statsCounter struct {
+	now                        time.Time
+	byType, byLabel, byWeekday map[string]int
+	byMonth                    map[[2]int]int
+	next                       map[string]time.Time
+	nextDoc                    map[string]bson.Raw
+}
+
+func newStatsCounter(now time.Time) *statsCounter {
+	return &statsCounter{
+		now:       now,
+		byType:    map[string]int{},
+		byLabel:   map[string]int{},
+		byWeekday: map[string]int{},
+		byMonth:   map[[2]int]int{},
+		next:      map[string]time.Time{},
+		nextDoc:   map[string]bson.Raw{},
+	}
+}
+
+// Counts the document. The document is copied if kept, it may be reused by the caller.
+func (c *statsCounter) add(raw bson.Raw) {
+	var d statsDate
+	if err := bson.Unmarshal(raw, &d); err != nil {
+		return
+	}
+	c.byType[d.Type]++
+	for _, l := range d.Labels {
+		c.byLabel[l]++
+	}
+	c.byMonth[[2]int{d.Year, d.Month}]++
+
+	if d.Year < 1 || d.Year > 9999 {
+		return
+	}
+	when := time.Date(d.Year, time.Month(d.Month), d.Day, d.Hours, d.Minutes, 0, 0, time.UTC)
+	c.byWeekday[isoWeekdays[(int(when.Weekday())+6)%7].(string)]++
+	if when.Before(c.now) {
+		return
+	}
+	if t, ok := c.next[d.Type]; !ok || when.Before(t) {
+		c.next[d.Type] = when
+		c.nextDoc[d.Type] = append(bson.Raw(nil), raw...)
+	}
+}
+
+// Returns the statistics of the documents counted so far, in the shape produced by
+// [DateStatsPipeline]
+func (c *statsCounter) stats() bson.D {
+	months := make([]monthCount, 0, len(c.byMonth))
+	for k, n := range c.byMonth {
+		months = append(months, monthCount{Year: k[0], Month: k[1], Count: n})
+	}
+	sort.Slice(months, func(i, j int) bool {
+		if months[i].Year != months[j].Year {
+			return months[i].Year < months[j].Year
+		}
+		return months[i].Month < months[j].Month
+	})
+	var busiest *monthCount
+	for i, m := range months {
+		if busiest == nil || m.Count > busiest.Count {
+			busiest = &months[i]
+		}
+	}
+
+	types := make([]string, 0, len(c.next))
+	for t := range c.next {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return c.next[types[i]].Before(c.next[types[j]])
+	})
+	nextPerType := make([]bson.Raw, 0, len(types))
+	for _, t := range types {
+		nextPerType = append(nextPerType, c.nextDoc[t])
+	}
+
+	stats := bson.D{
+		{Key: "byType", Value: sortedCounts(c.byType)},
+		{Key: "byLabel", Value: sortedCounts(c.byLabel)},
+		{Key: "byMonth", Value: months},
+		{Key: "byWeekday", Value: sortedCounts(c.byWeekday)},
+		{Key: "nextPerType", Value: nextPerType},
+	}
+	if busiest != nil {
+		stats = append(stats, bson.E{Key: "busiestMonth", Value: *busiest})
+	}
+	return stats
+}
+
+// Computes the statistics of the documents the way [DateStatsPipeline] does
+func dateStats(docs []bson.Raw, now time.Time) bson.D {
+	c := newStatsCounter(now)
+	for _, raw := range docs {
+		c.add(raw)
+	}
+	return c.stats()
+}
@@ -0,0 +1,170 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Dates the statistics are computed from, the ones of [TestDateStats]
+var statsFixture = []bson.D{
+	{{Key: "_id", Value: 1}, {Key: "type", Value: "birthday"}, {Key: "labels", Value: bson.A{"family"}}, {Key: "year", Value: 2024}, {Key: "month", Value: 6}, {Key: "day", Value: 3}},
+	{{Key: "_id", Value: 2}, {Key: "type", Value: "birthday"}, {Key: "labels", Value: bson.A{"family", "friends"}}, {Key: "year", Value: 2024}, {Key: "month", Value: 6}, {Key: "day", Value: 1}, {Key: "hours", Value: 18}},
+	{{Key: "_id", Value: 3}, {Key: "type", Value: "meeting"}, {Key: "labels", Value: bson.A{"work"}}, {Key: "year", Value: 2024}, {Key: "month", Value: 5}, {Key: "day", Value: 31}},
+	{{Key: "_id", Value: 4}, {Key: "type", Value: "meeting"}, {Key: "year", Value: 2025}, {Key: "month", Value: 1}, {Key: "day", Value: 6}},
+	// not representable as a point in time, only counted by type, label and month
+	{{Key: "_id", Value: 5}, {Key: "type", Value: "holiday"}, {Key: "year", Value: -44}, {Key: "month", Value: 3}, {Key: "day", Value: 15}},
+}
+
+var statsNow = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// Statistics as read back from [dateStats] or [DateStatsPipeline]
+type decodedStats struct {
+	ByType       []keyCount   `bson:"byType"`
+	ByLabel      []keyCount   `bson:"byLabel"`
+	ByMonth      []monthCount `bson:"byMonth"`
+	ByWeekday    []keyCount   `bson:"byWeekday"`
+	BusiestMonth *monthCount  `bson:"busiestMonth"`
+	NextPerType  []bson.M     `bson:"nextPerType"`
+}
+
+func decodeStats(t *testing.T, stats any) decodedStats {
+	t.Helper()
+	raw, err := bson.Marshal(stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got decodedStats
+	if err := bson.Unmarshal(raw, &got); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestDateStats(t *testing.T) {
+	docs := make([]bson.Raw, len(statsFixture))
+	for i, d := range statsFixture {
+		raw, err := bson.Marshal(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs[i] = raw
+	}
+	got := decodeStats(t, dateStats(docs, statsNow))
+
+	check := func(name string, got, want any) {
+		t.Helper()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+	check("byType", got.ByType, []keyCount{{"birthday", 2}, {"meeting", 2}, {"holiday", 1}})
+	check("byLabel", got.ByLabel, []keyCount{{"family", 2}, {"friends", 1}, {"work", 1}})
+	check("byMonth", got.ByMonth, []monthCount{{-44, 3, 1}, {2024, 5, 1}, {2024, 6, 2}, {2025, 1, 1}})
+	// 2024-06-03 and 2025-01-06 are mondays, 2024-06-01 a saturday, 2024-05-31 a friday
+	check("byWeekday", got.ByWeekday, []keyCount{{"Monday", 2}, {"Friday", 1}, {"Saturday", 1}})
+	check("busiestMonth", got.BusiestMonth, &monthCount{2024, 6, 2})
+	ids := []any{}
+	for _, d := range got.NextPerType {
+		ids = append(ids, d["_id"])
+	}
+	check("nextPerType", ids, []any{int32(2), int32(4)})
+}
+
+func TestDateStatsEmpty(t *testing.T) {
+	stats := dateStats(nil, time.Now()).Map()
+	if _, ok := stats["busiestMonth"]; ok {
+		t.Error("busiest month of no dates")
+	}
+}
+
+// Runs the statistics pipeline against the MongoDB named by REMINDAL_TEST_MONGO_URI and
+// checks that the fallback computes the same statistics. Skipped without a database.
+func TestDateStatsMatchesPipeline(t *testing.T) {
+	uri := os.Getenv("REMINDAL_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("REMINDAL_TEST_MONGO_URI not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	c, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect(ctx)
+	db := c.Database(fmt.Sprintf("remindal_test_%d", time.Now().UnixNano()))
+	defer db.Drop(ctx)
+	coll := db.Collection(CALENDAR_COLLECTION)
+
+	docs := make([]any, len(statsFixture))
+	for i, d := range statsFixture {
+		docs[i] = d
+	}
+	if _, err := coll.InsertMany(ctx, docs); err != nil {
+		t.Fatal(err)
+	}
+
+	cursor, err := coll.Aggregate(ctx, DateStatsPipeline(bson.D{}, statsNow))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []bson.Raw
+	if err := cursor.All(ctx, &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("pipeline produced %d documents, want 1", len(results))
+	}
+	want := decodeStats(t, results[0])
+
+	counter := newStatsCounter(statsNow)
+	err = scan(ctx, coll, bson.D{}, options.Find().SetSort(CreateSort("_id", 1)), func(raw bson.Raw) error {
+		counter.add(raw)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := decodeStats(t, counter.stats())
+
+	if !reflect.DeepEqual(got.ByType, want.ByType) ||
+		!reflect.DeepEqual(got.ByLabel, want.ByLabel) ||
+		!reflect.DeepEqual(got.ByMonth, want.ByMonth) ||
+		!reflect.DeepEqual(got.ByWeekday, want.ByWeekday) ||
+		!reflect.DeepEqual(got.BusiestMonth, want.BusiestMonth) {
+		t.Errorf("fallback statistics = %+v, pipeline = %+v", got, want)
+	}
+	if len(got.NextPerType) != len(want.NextPerType) {
+		t.Fatalf("fallback next per type = %v, pipeline = %v", got.NextPerType, want.NextPerType)
+	}
+	for i := range got.NextPerType {
+		if got.NextPerType[i]["_id"] != want.NextPerType[i]["_id"] {
+			t.Errorf("fallback next per type = %v, pipeline = %v", got.NextPerType, want.NextPerType)
+			break
+		}
+	}
+}
+
+// Cursors reuse the buffer of the current document, the kept ones must be copies
+func TestStatsCounterCopiesDocuments(t *testing.T) {
+	raw, err := bson.Marshal(statsFixture[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newStatsCounter(statsNow)
+	c.add(raw)
+	clear(raw)
+
+	got := decodeStats(t, c.stats())
+	if len(got.NextPerType) != 1 || got.NextPerType[0]["_id"] != int32(4) {
+		t.Errorf("next per type = %v, want the document with _id 4", got.NextPerType)
+	}
+}
@@ -0,0 +1,297 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Fields of the dates searched by the full-text search, with their weights. Shared by
+// the text index and the inverted index used where text indexes are not supported.
+var calendarTextWeights = bson.D{
+	{Key: "labels", Value: 3},
+	{Key: "type", Value: 2},
+	{Key: "description", Value: 1},
+}
+
+// Set when the backend refused to create the text index, e.g. a MongoDB compatible
+// database without full-text search. Searches then go through an inverted index
+// built from the documents matching the other filters.
+var textIndexUnsupported atomic.Bool
+
+// Splits the $text filter off the query. Returns the search, the rest of the query and
+// whether the query has a $text filter.
+func splitTextSearch(query bson.D) (string, bson.D, bool) {
+	for i, e := range query {
+		if e.Key != "$text" {
+			continue
+		}
+		var search string
+		if d, ok := e.Value.(bson.D); ok {
+			for _, f := range d {
+				if f.Key == "$search" {
+					search, _ = f.Value.(string)
+				}
+			}
+		}
+		rest := append(append(bson.D{}, query[:i]...), query[i+1:]...)
+		return search, rest, true
+	}
+	return "", query, false
+}
+
+// Removes the sort by relevance, which only text indexes can compute, from the sort.
+// Reports whether the sort was by relevance.
+func withoutTextScore(sort bson.D) (bson.D, bool) {
+	rest := bson.D{}
+	byScore := false
+	for _, e := range sort {
+		if d, ok := e.Value.(bson.D); ok && len(d) == 1 && d[0].Key == "$meta" {
+			byScore = true
+			continue
+		}
+		rest = append(rest, e)
+	}
+	return rest, byScore
+}
+
+// Most documents matching the rest of the query a search without text index goes
+// through, as they are all held in memory while the search runs
+const MAX_SEARCH_SCAN = 10_000
+
+// Runs the search over the documents of the collection matching the rest of the query,
+// through an inverted index of their text fields, and unmarshals the matching ones into
+// dest, which must be a pointer to a slice. Documents are ordered by relevance first if
+// the sort asks for it, then by the rest of the sort. Fails with [ErrTooMany] if more
+// than MAX_SEARCH_SCAN documents match the rest of the query.
+func searchWithoutIndex(ctx context.Context, coll *mongo.Collection, search string, rest bson.D, sort bson.D, dest any) error {
+	sort, byScore := withoutTextScore(sort)
+	index := newInvertedIndex(calendarTextWeights)
+	var docs []bson.Raw
+	opts := options.Find().SetSort(sort).SetLimit(MAX_SEARCH_SCAN + 1)
+	err := scan(ctx, coll, rest, opts, func(raw bson.Raw) error {
+		if len(docs) == MAX_SEARCH_SCAN {
+			return fmt.Errorf("%w: the search matches more than %d documents, narrow it with other filters", ErrTooMany, MAX_SEARCH_SCAN)
+		}
+		index.add(len(docs), raw)
+		docs = append(docs, append(bson.Raw(nil), raw...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	matches := index.search(parseSearch(search))
+
+	out := reflect.ValueOf(dest).Elem()
+	out.Set(reflect.MakeSlice(out.Type(), 0, len(matches)))
+	for _, m := range orderMatches(matches, byScore) {
+		elem := reflect.New(out.Type().Elem())
+		if err := bson.Unmarshal(docs[m.doc], elem.Interface()); err != nil {
+			return err
+		}
+		out.Set(reflect.Append(out, elem.Elem()))
+	}
+	return nil
+}
+
+// Splits the text in lowercase words without diacritics, the way text indexes with the
+// "none" language do
+func tokenize(s string) []string {
+	// transformers keep state, a new one is needed for every text
+	fold := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(fold, s)
+	if err != nil {
+		folded = s
+	}
+	return strings.FieldsFunc(strings.ToLower(folded), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Search as understood by $text: words any of which must match, phrases in double
+// quotes all of which must match, and words preceded by a minus none of which must
+// match
+type textSearch struct {
+	terms    []string
+	phrases  []string
+	excluded []string
+}
+
+func parseSearch(s string) textSearch {
+	var q textSearch
+	for {
+		start := strings.IndexByte(s, '"')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(s[start+1:], '"')
+		if end < 0 {
+			break
+		}
+		if p := tokenize(s[start+1 : start+1+end]); len(p) > 0 {
+			q.phrases = append(q.phrases, strings.Join(p, " "))
+			// the words of a phrase count for the relevance too
+			q.terms = append(q.terms, p...)
+		}
+		s = s[:start] + " " + s[start+2+end:]
+	}
+	for _, f := range strings.Fields(s) {
+		if strings.HasPrefix(f, "-") {
+			q.excluded = append(q.excluded, tokenize(f[1:])...)
+			continue
+		}
+		q.terms = append(q.terms, tokenize(f)...)
+	}
+	return q
+}
+
+// Posting of a word: how many times it occurs in a field of a document
+type posting struct {
+	doc   int
+	field int
+	count int
+}
+
+// Inverted index of the text fields of a set of documents
+type invertedIndex struct {
+	weights bson.D
+	words   map[string][]posting
+	// number of words of every field of every document
+	lengths map[int][]int
+	// words of every field of every document joined by spaces, to look for phrases
+	texts map[int][]string
+}
+
+func newInvertedIndex(weights bson.D) *invertedIndex {
+	return &invertedIndex{
+		weights: weights,
+		words:   map[string][]posting{},
+		lengths: map[int][]int{},
+		texts:   map[int][]string{},
+	}
+}
+
+// Indexes the text fields of the document. Fields holding arrays of strings, like the
+// labels, are indexed as a single text.
+func (ix *invertedIndex) add(doc int, raw bson.Raw) {
+	lengths := make([]int, len(ix.weights))
+	texts := make([]string, len(ix.weights))
+	for f, w := range ix.weights {
+		words := tokenize(fieldText(raw, w.Key))
+		counts := map[string]int{}
+		for _, word := range words {
+			counts[word]++
+		}
+		for word, n := range counts {
+			ix.words[word] = append(ix.words[word], posting{doc: doc, field: f, count: n})
+		}
+		lengths[f] = len(words)
+		texts[f] = " " + strings.Join(words, " ") + " "
+	}
+	ix.lengths[doc] = lengths
+	ix.texts[doc] = texts
+}
+
+// Returns the text of the field of the document, the strings of arrays joined by spaces
+func fieldText(raw bson.Raw, key string) string {
+	v, err := raw.LookupErr(key)
+	if err != nil {
+		return ""
+	}
+	if s, ok := v.StringValueOK(); ok {
+		return s
+	}
+	arr, ok := v.ArrayOK()
+	if !ok {
+		return ""
+	}
+	values, err := arr.Values()
+	if err != nil {
+		return ""
+	}
+	parts := make([]string, 0, len(values))
+	for _, e := range values {
+		if s, ok := e.StringValueOK(); ok {
+			parts = append(parts, s)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// Document matching a search, with its relevance
+type match struct {
+	doc   int
+	score float64
+}
+
+// Returns the documents matching the search with their relevance. Every word found in
+// a field adds the weight of the field, more so the larger the share of the field the
+// word makes up, in the spirit of the scores of text indexes.
+func (ix *invertedIndex) search(q textSearch) []match {
+	scores := map[int]float64{}
+	seen := map[string]bool{}
+	for _, term := range q.terms {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+		for _, p := range ix.words[term] {
+			weight := float64(ix.weights[p.field].Value.(int))
+			freq := float64(p.count) / float64(ix.lengths[p.doc][p.field])
+			scores[p.doc] += weight * (0.5 + 0.5*freq)
+		}
+	}
+	for _, term := range q.excluded {
+		for _, p := range ix.words[term] {
+			delete(scores, p.doc)
+		}
+	}
+
+	matches := make([]match, 0, len(scores))
+	for doc, score := range scores {
+		if ix.hasPhrases(doc, q.phrases) {
+			matches = append(matches, match{doc: doc, score: score})
+		}
+	}
+	return matches
+}
+
+// Reports whether every phrase occurs in one of the fields of the document
+func (ix *invertedIndex) hasPhrases(doc int, phrases []string) bool {
+	for _, p := range phrases {
+		found := false
+		for _, text := range ix.texts[doc] {
+			if strings.Contains(text, " "+p+" ") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Orders the matches by relevance if asked to, keeping the order of the documents
+// among equally relevant ones, by the order of the documents otherwise
+func orderMatches(matches []match, byScore bool) []match {
+	sort.Slice(matches, func(i, j int) bool {
+		if byScore && matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].doc < matches[j].doc
+	})
+	return matches
+}
@@ -0,0 +1,98 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestTokenize(t *testing.T) {
+	got := tokenize("Café DENTIST, rendez-vous à 9h30!")
+	want := []string{"cafe", "dentist", "rendez", "vous", "a", "9h30"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tokenize = %q, want %q", got, want)
+	}
+}
+
+func TestParseSearch(t *testing.T) {
+	got := parseSearch(`Dentist "check UP" -Cancelled`)
+	want := textSearch{
+		terms:    []string{"check", "up", "dentist"},
+		phrases:  []string{"check up"},
+		excluded: []string{"cancelled"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseSearch = %+v, want %+v", got, want)
+	}
+}
+
+func TestSplitTextSearch(t *testing.T) {
+	b := NewQueryBuilder()
+	b.AddField("owner", "user@example.com")
+	b.AddTextSearch("dentist")
+	b.AddField("type", "appointment")
+
+	search, rest, ok := splitTextSearch(b.Query())
+	if !ok || search != "dentist" {
+		t.Fatalf("splitTextSearch = %q, %v", search, ok)
+	}
+	want := bson.D{{Key: "owner", Value: "user@example.com"}, {Key: "type", Value: "appointment"}}
+	if !reflect.DeepEqual(rest, want) {
+		t.Errorf("rest of the query = %v, want %v", rest, want)
+	}
+	if _, _, ok := splitTextSearch(want); ok {
+		t.Error("query without $text reported as a search")
+	}
+
+	sort, byScore := withoutTextScore(CreateTextScoreSort("year", -1))
+	if !byScore || !reflect.DeepEqual(sort, CreateSort("year", -1)) {
+		t.Errorf("withoutTextScore = %v, %v", sort, byScore)
+	}
+}
+
+// Returns the descriptions of the documents matching the search, most relevant first
+func searchDocs(t *testing.T, docs []bson.D, search string) []string {
+	t.Helper()
+	index := newInvertedIndex(calendarTextWeights)
+	for i, d := range docs {
+		raw, err := bson.Marshal(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index.add(i, raw)
+	}
+	got := []string{}
+	for _, m := range orderMatches(index.search(parseSearch(search)), true) {
+		got = append(got, docs[m.doc].Map()["description"].(string))
+	}
+	return got
+}
+
+func TestInvertedIndex(t *testing.T) {
+	docs := []bson.D{
+		{{Key: "type", Value: "appointment"}, {Key: "description", Value: "Dentist check up"}},
+		{{Key: "type", Value: "appointment"}, {Key: "labels", Value: bson.A{"dentist"}}, {Key: "description", Value: "Yearly visit"}},
+		{{Key: "type", Value: "birthday"}, {Key: "description", Value: "Zoé"}},
+		{{Key: "type", Value: "appointment"}, {Key: "description", Value: "Dentist, cancelled"}},
+		{{Key: "type", Value: "meeting"}, {Key: "description", Value: "Up to check the budget"}},
+	}
+	tests := []struct {
+		search string
+		want   []string
+	}{
+		// labels weigh more than descriptions
+		{"DENTIST", []string{"Yearly visit", "Dentist, cancelled", "Dentist check up"}},
+		{"zoe", []string{"Zoé"}},
+		{"dentist -cancelled", []string{"Yearly visit", "Dentist check up"}},
+		{`"check up"`, []string{"Dentist check up"}},
+		{"birthday visit", []string{"Zoé", "Yearly visit"}},
+		{"holiday", []string{}},
+		{"-dentist", []string{}},
+	}
+	for _, tt := range tests {
+		if got := searchDocs(t, docs, tt.search); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("search %q = %q, want %q", tt.search, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package ical
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"time"
+)
+
+// Longest line allowed by RFC 5545, in octets, longer ones are folded
+const MAX_LINE = 75
+
+// Event of a calendar
+type Event struct {
+	UID   string
+	Start time.Time
+	// whether only the day of the start matters
+	AllDay      bool
+	Summary     string
+	Description string
+	Categories  []string
+}
+
+// Escapes the text as required in the values of the properties
+func escape(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(s)
+}
+
+// Writes the line ended by CRLF, folding it into lines of at most MAX_LINE octets
+// without splitting multi-byte characters
+func writeLine(w *bufio.Writer, line string) {
+	limit := MAX_LINE
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		w.WriteString(line[:cut])
+		w.WriteString("\r\n ")
+		line = line[cut:]
+		// the space starting the continuation line counts
+		limit = MAX_LINE - 1
+	}
+	w.WriteString(line)
+	w.WriteString("\r\n")
+}
+
+// Writes the events as an iCalendar (RFC 5545) calendar. Times are floating, that is
+// in the local time of whoever reads the calendar, since the dates carry no time zone.
+func Write(out io.Writer, prodID string, events []Event) error {
+	w := bufio.NewWriter(out)
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	writeLine(w, "BEGIN:VCALENDAR")
+	writeLine(w, "VERSION:2.0")
+	writeLine(w, "PRODID:"+prodID)
+	writeLine(w, "CALSCALE:GREGORIAN")
+	for _, e := range events {
+		writeLine(w, "BEGIN:VEVENT")
+		writeLine(w, "UID:"+escape(e.UID))
+		writeLine(w, "DTSTAMP:"+stamp)
+		if e.AllDay {
+			writeLine(w, "DTSTART;VALUE=DATE:"+e.Start.Format("20060102"))
+		} else {
+			writeLine(w, "DTSTART:"+e.Start.Format("20060102T150405"))
+		}
+		writeLine(w, "SUMMARY:"+escape(e.Summary))
+		if e.Description != "" {
+			writeLine(w, "DESCRIPTION:"+escape(e.Description))
+		}
+		if len(e.Categories) > 0 {
+			cats := make([]string, len(e.Categories))
+			for i, c := range e.Categories {
+				cats[i] = escape(c)
+			}
+			writeLine(w, "CATEGORIES:"+strings.Join(cats, ","))
+		}
+		writeLine(w, "END:VEVENT")
+	}
+	writeLine(w, "END:VCALENDAR")
+	return w.Flush()
+}
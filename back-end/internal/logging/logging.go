@@ -0,0 +1,75 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+)
+
+const REDACTED = "[REDACTED]"
+
+// Keys of the attributes and query parameters whose value is never logged, compared case insensitively
+var sensitiveKeys = map[string]bool{
+	"password":      true,
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"id_token":      true,
+	"authorization": true,
+	"secret":        true,
+	"api_key":       true,
+	"apikey":        true,
+	"cookie":        true,
+}
+
+type ctxKey struct{}
+
+// Returns a copy of the context carrying the logger
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, logger)
+}
+
+// Returns the logger carried by the context, the default one if there is none
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(ctxKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Reports whether the value of the key must not be logged
+func IsSensitive(key string) bool {
+	return sensitiveKeys[strings.ToLower(key)]
+}
+
+// Replaces the value of the sensitive attributes, meant to be used as [slog.HandlerOptions.ReplaceAttr]
+func Redact(groups []string, a slog.Attr) slog.Attr {
+	if IsSensitive(a.Key) {
+		return slog.String(a.Key, REDACTED)
+	}
+	return a
+}
+
+// Encodes the query replacing the values of the sensitive parameters
+func RedactQuery(q url.Values) string {
+	redacted := url.Values{}
+	for k, vs := range q {
+		if IsSensitive(k) {
+			redacted[k] = []string{REDACTED}
+			continue
+		}
+		redacted[k] = vs
+	}
+	return redacted.Encode()
+}
+
+// Returns a handler writing JSON records of at least the given level, with the
+// sensitive attributes redacted
+func NewHandler(w io.Writer, level slog.Level) slog.Handler {
+	return slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: Redact,
+	})
+}
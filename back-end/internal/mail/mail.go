@@ -0,0 +1,78 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"remindal/internal/logging"
+	"strings"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Delivers the emails sent by the application
+type Sender interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// Sends the emails through an SMTP server, authenticating with PLAIN if a username
+// is set. The connection is upgraded with STARTTLS when the server supports it.
+type SMTPSender struct {
+	// host:port of the server
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s SMTPSender) Send(ctx context.Context, m Message) error {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	// net/smtp does not take a context, the send is abandoned rather than interrupted
+	errc := make(chan error, 1)
+	go func() {
+		errc <- smtp.SendMail(s.Addr, auth, s.From, []string{m.To}, s.format(m))
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Formats the message as a plain text email
+func (s SMTPSender) format(m Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", s.From)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// Logs the emails instead of sending them, meant for development. The body is left out,
+// the links it holds carry tokens granting access to the account.
+type LogSender struct{}
+
+func (LogSender) Send(ctx context.Context, m Message) error {
+	logging.FromContext(ctx).Info("email", "to", m.To, "subject", m.Subject)
+	return nil
+}
@@ -0,0 +1,165 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	gooidc "github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Scopes requested from the provider, the ones telling who the user is and their email
+var SCOPES = []string{gooidc.ScopeOpenID, "email", "profile"}
+
+var ErrInvalidToken = errors.New("invalid ID token")
+
+var encoding = base64.RawURLEncoding
+
+// Claims of the ID token identifying the user
+type Claims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified Bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	GivenName     string `json:"given_name"`
+	FamilyName    string `json:"family_name"`
+}
+
+// Boolean claim, which some providers send as a string
+type Bool bool
+
+func (b *Bool) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	*b = Bool(s == "true")
+	return nil
+}
+
+// OpenID Connect provider the users log in with, using the authorization code flow
+// with PKCE. Its endpoints and signing keys are discovered on first use from the
+// issuer, the ID tokens are verified by go-oidc.
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Client       *http.Client
+
+	mu       sync.Mutex
+	provider *gooidc.Provider
+}
+
+// Returns a new random value for the state, the nonce or the code verifier of a login
+func NewRandom() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// Returns the S256 code challenge of the code verifier, as defined by RFC 7636
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return encoding.EncodeToString(sum[:])
+}
+
+// Returns the context the requests to the provider are made with, through its client
+func (p *Provider) context(ctx context.Context) context.Context {
+	if p.Client == nil {
+		return ctx
+	}
+	return gooidc.ClientContext(ctx, p.Client)
+}
+
+// Returns the provider as discovered from the issuer, discovering it the first time.
+// The issuer of the discovery document must match the configured one.
+func (p *Provider) discover(ctx context.Context) (*gooidc.Provider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.provider != nil {
+		return p.provider, nil
+	}
+	provider, err := gooidc.NewProvider(p.context(ctx), p.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	p.provider = provider
+	return p.provider, nil
+}
+
+// Returns the OAuth 2.0 configuration of the client at the provider. Confidential
+// clients authenticate with HTTP basic authentication, public ones only send their ID.
+func (p *Provider) oauth2Config(provider *gooidc.Provider) *oauth2.Config {
+	endpoint := provider.Endpoint()
+	endpoint.AuthStyle = oauth2.AuthStyleInHeader
+	if p.ClientSecret == "" {
+		endpoint.AuthStyle = oauth2.AuthStyleInParams
+	}
+	return &oauth2.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		RedirectURL:  p.RedirectURL,
+		Endpoint:     endpoint,
+		Scopes:       SCOPES,
+	}
+}
+
+// Returns the URL of the provider the user logs in at. The state and the nonce are
+// checked when the user is sent back, the code verifier when the code is exchanged.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	provider, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	return p.oauth2Config(provider).AuthCodeURL(state, gooidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), nil
+}
+
+// Exchanges the authorization code for the tokens of the user and returns the claims
+// of the verified ID token
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (Claims, error) {
+	provider, err := p.discover(ctx)
+	if err != nil {
+		return Claims{}, err
+	}
+	tokens, err := p.oauth2Config(provider).Exchange(p.context(ctx), code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return Claims{}, fmt.Errorf("token endpoint: %w", err)
+	}
+	raw, ok := tokens.Extra("id_token").(string)
+	if !ok || raw == "" {
+		return Claims{}, errors.New("token endpoint: no ID token returned")
+	}
+	return p.Verify(ctx, raw, nonce)
+}
+
+// Checks the signature, the issuer, the audience, the expiration and the nonce of the
+// ID token and returns its claims
+func (p *Provider) Verify(ctx context.Context, token, nonce string) (Claims, error) {
+	provider, err := p.discover(ctx)
+	if err != nil {
+		return Claims{}, err
+	}
+	idToken, err := provider.Verifier(&gooidc.Config{ClientID: p.ClientID}).Verify(p.context(ctx), token)
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		return Claims{}, fmt.Errorf("%w: nonce mismatch", ErrInvalidToken)
+	}
+	var claims Claims
+	if err := idToken.Claims(&claims); err != nil {
+		return Claims{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if claims.Subject == "" {
+		return Claims{}, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+	return claims, nil
+}
@@ -0,0 +1,226 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+)
+
+const (
+	testClientID = "remindal"
+	testKid      = "key-1"
+)
+
+// Provider issuing ID tokens signed with its RSA key, as real ones do
+type testIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu sync.Mutex
+	// code challenges of the logins, by their authorization code
+	challenges map[string]string
+	// ID token returned for the next code exchanged
+	token string
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss := &testIssuer{key: key, challenges: map[string]string{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                iss.URL,
+			"authorization_endpoint":                iss.URL + "/authorize",
+			"token_endpoint":                        iss.URL + "/token",
+			"jwks_uri":                              iss.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+			Key:       &iss.key.PublicKey,
+			KeyID:     testKid,
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		iss.mu.Lock()
+		challenge, ok := iss.challenges[r.PostFormValue("code")]
+		delete(iss.challenges, r.PostFormValue("code"))
+		token := iss.token
+		iss.mu.Unlock()
+		if !ok || r.PostFormValue("client_id") != testClientID || Challenge(r.PostFormValue("code_verifier")) != challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "access", "token_type": "Bearer", "id_token": token})
+	})
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+// Returns the claims of a valid ID token for the login with the nonce
+func (iss *testIssuer) claims(nonce string) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":            iss.URL,
+		"aud":            testClientID,
+		"sub":            "subject-1",
+		"email":          "user@example.com",
+		"email_verified": true,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          nonce,
+	}
+}
+
+// Returns the ID token with the claims, signed with the key
+func sign(t *testing.T, key *rsa.PrivateKey, claims map[string]any) string {
+	t.Helper()
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: key, KeyID: testKid}},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// Starts a login at the issuer, which will answer the code exchange with the token.
+// Returns the code the user is sent back with, the verifier and the nonce.
+func (iss *testIssuer) login(t *testing.T, p *Provider, token func(nonce string) string) (string, string, string) {
+	t.Helper()
+	state, _ := NewRandom()
+	nonce, _ := NewRandom()
+	verifier, _ := NewRandom()
+	u, err := p.AuthCodeURL(context.Background(), state, nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := parsed.Query()
+	if q.Get("state") != state || q.Get("nonce") != nonce || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected login URL %s", u)
+	}
+	code, _ := NewRandom()
+	iss.mu.Lock()
+	iss.challenges[code] = q.Get("code_challenge")
+	iss.token = token(q.Get("nonce"))
+	iss.mu.Unlock()
+	return code, verifier, nonce
+}
+
+func newTestProvider(iss *testIssuer) *Provider {
+	return &Provider{
+		Issuer:      iss.URL,
+		ClientID:    testClientID,
+		RedirectURL: "https://remindal.example/user/oidc/callback",
+		Client:      iss.Client(),
+	}
+}
+
+func TestExchange(t *testing.T) {
+	iss := newTestIssuer(t)
+	p := newTestProvider(iss)
+	code, verifier, nonce := iss.login(t, p, func(nonce string) string {
+		return sign(t, iss.key, iss.claims(nonce))
+	})
+
+	claims, err := p.Exchange(context.Background(), code, verifier, nonce)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if claims.Subject != "subject-1" || claims.Email != "user@example.com" || !claims.EmailVerified {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+
+	// the code was consumed and the verifier is checked
+	if _, err := p.Exchange(context.Background(), code, verifier, nonce); err == nil {
+		t.Error("code exchanged twice")
+	}
+	code, _, nonce = iss.login(t, p, func(nonce string) string {
+		return sign(t, iss.key, iss.claims(nonce))
+	})
+	if _, err := p.Exchange(context.Background(), code, "wrong-verifier", nonce); err == nil {
+		t.Error("code exchanged with the wrong verifier")
+	}
+}
+
+func TestExchangeRejectsInvalidTokens(t *testing.T) {
+	iss := newTestIssuer(t)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		token func(nonce string) string
+	}{
+		{"bad signature", func(nonce string) string {
+			return sign(t, other, iss.claims(nonce))
+		}},
+		{"wrong audience", func(nonce string) string {
+			c := iss.claims(nonce)
+			c["aud"] = []string{"another-client"}
+			return sign(t, iss.key, c)
+		}},
+		{"expired", func(nonce string) string {
+			c := iss.claims(nonce)
+			c["iat"] = time.Now().Add(-2 * time.Hour).Unix()
+			c["exp"] = time.Now().Add(-time.Hour).Unix()
+			return sign(t, iss.key, c)
+		}},
+		{"wrong nonce", func(nonce string) string {
+			return sign(t, iss.key, iss.claims("another-nonce"))
+		}},
+		{"wrong issuer", func(nonce string) string {
+			c := iss.claims(nonce)
+			c["iss"] = "https://evil.example"
+			return sign(t, iss.key, c)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProvider(iss)
+			code, verifier, nonce := iss.login(t, p, tt.token)
+			_, err := p.Exchange(context.Background(), code, verifier, nonce)
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("Exchange = %v, want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+}
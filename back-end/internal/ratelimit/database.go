@@ -0,0 +1,52 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	db "remindal/internal/database"
+	"time"
+)
+
+// Store keeping the counters in the database, so that the limits are shared by every
+// instance of the server. Expired counters are removed by the database.
+type DatabaseStore struct{}
+
+func (DatabaseStore) Take(ctx context.Context, key string, limit Limit, now time.Time) (time.Duration, error) {
+	b, err := db.TakeToken(ctx, key, limit.Count, limit.Rate(), now)
+	// two first requests racing to create the bucket, the loser finds it on retry
+	if errors.Is(err, db.ErrConflict) {
+		b, err = db.TakeToken(ctx, key, limit.Count, limit.Rate(), now)
+	}
+	if err != nil || b.Allowed {
+		return 0, err
+	}
+	return waitFor(b.Tokens, limit), nil
+}
+
+func (DatabaseStore) Fail(ctx context.Context, key string, now time.Time) (int, error) {
+	c, err := db.RecordFailure(ctx, key, now, FAILURE_MEMORY)
+	if errors.Is(err, db.ErrConflict) {
+		c, err = db.RecordFailure(ctx, key, now, FAILURE_MEMORY)
+	}
+	return c.Failures, err
+}
+
+func (DatabaseStore) Lock(ctx context.Context, key string, until time.Time) error {
+	return db.LockKey(ctx, key, until)
+}
+
+func (DatabaseStore) LockedUntil(ctx context.Context, key string) (time.Time, error) {
+	c, err := db.GetFailures(ctx, key)
+	if errors.Is(err, db.ErrNotFound) {
+		return time.Time{}, nil
+	}
+	return c.LockedUntil, err
+}
+
+func (DatabaseStore) Reset(ctx context.Context, key string) error {
+	err := db.DeleteOne(ctx, db.RATELIMIT_COLLECTION, "_id", key)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,157 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long the failures of a key are remembered after the last one
+const FAILURE_MEMORY = 24 * time.Hour
+
+// Maximum number of requests within a period, refilled continuously. The whole
+// count can be spent in a burst. The zero value allows every request.
+type Limit struct {
+	Count  int
+	Period time.Duration
+}
+
+// Reports whether the limit lets every request through
+func (l Limit) Unlimited() bool {
+	return l.Count <= 0 || l.Period <= 0
+}
+
+// Tokens refilled per second
+func (l Limit) Rate() float64 {
+	return float64(l.Count) / l.Period.Seconds()
+}
+
+func (l Limit) String() string {
+	if l.Unlimited() {
+		return "0"
+	}
+	return fmt.Sprintf("%d/%s", l.Count, l.Period)
+}
+
+// Parses a limit written as count/period, e.g. 10/1m or 5/s. 0 disables the limit.
+func (l *Limit) UnmarshalText(text []byte) error {
+	s := string(text)
+	if s == "0" || s == "" {
+		*l = Limit{}
+		return nil
+	}
+	count, period, ok := strings.Cut(s, "/")
+	if !ok {
+		return fmt.Errorf("limit %q must be written as count/period, e.g. 10/1m", s)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return fmt.Errorf("count of limit %q must be a non negative integer", s)
+	}
+	if period != "" && (period[0] < '0' || period[0] > '9') {
+		period = "1" + period
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("period of limit %q must be a positive duration", s)
+	}
+	*l = Limit{Count: n, Period: d}
+	return nil
+}
+
+func (l Limit) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// Keeps the token buckets and the failure counters, shared by every instance of
+// the server if the store is
+type Store interface {
+	// Takes a token from the bucket of the key. Returns how long until a token is
+	// available if the bucket is empty, 0 if the token was taken.
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (time.Duration, error)
+	// Records a failure of the key and returns the number of failures since the
+	// last reset, forgetting the ones older than [FAILURE_MEMORY]
+	Fail(ctx context.Context, key string, now time.Time) (int, error)
+	// Locks the key until the given time
+	Lock(ctx context.Context, key string, until time.Time) error
+	// Returns the time the key is locked until, the zero time if it is not locked
+	LockedUntil(ctx context.Context, key string) (time.Time, error)
+	// Forgets the failures and the lock of the key
+	Reset(ctx context.Context, key string) error
+}
+
+// Locks an account after repeated failures for a time doubling with every further failure
+type Lockout struct {
+	// Failures allowed before the account is locked, 0 disables the lockout
+	Threshold int
+	// Duration of the first lock
+	Base time.Duration
+	// Maximum duration of a lock
+	Max time.Duration
+}
+
+// Returns how long an account is locked for after the given number of failures
+func (l Lockout) Duration(failures int) time.Duration {
+	if l.Threshold <= 0 || failures < l.Threshold {
+		return 0
+	}
+	d := l.Base
+	for i := l.Threshold; i < failures && d < l.Max; i++ {
+		d *= 2
+	}
+	return min(d, l.Max)
+}
+
+// Applies limits and lockouts on top of a store
+type Limiter struct {
+	Store   Store
+	Lockout Lockout
+}
+
+// Takes a token from the bucket of the key under the limit. Returns how long the
+// caller must wait if the limit is exceeded, 0 otherwise.
+func (l *Limiter) Allow(ctx context.Context, key string, limit Limit) (time.Duration, error) {
+	if limit.Unlimited() {
+		return 0, nil
+	}
+	return l.Store.Take(ctx, "bucket:"+key, limit, time.Now())
+}
+
+// Returns how long the account is still locked for, 0 if it is not locked
+func (l *Limiter) Locked(ctx context.Context, account string) (time.Duration, error) {
+	until, err := l.Store.LockedUntil(ctx, "login:"+account)
+	if err != nil {
+		return 0, err
+	}
+	return max(time.Until(until), 0), nil
+}
+
+// Records a failed login of the account, locking it once the failures reach the
+// threshold. Returns how long the account is locked for, 0 if it is not.
+func (l *Limiter) LoginFailed(ctx context.Context, account string) (time.Duration, error) {
+	now := time.Now()
+	failures, err := l.Store.Fail(ctx, "login:"+account, now)
+	if err != nil {
+		return 0, err
+	}
+	d := l.Lockout.Duration(failures)
+	if d == 0 {
+		return 0, nil
+	}
+	return d, l.Store.Lock(ctx, "login:"+account, now.Add(d))
+}
+
+// Forgets the failed logins of the account
+func (l *Limiter) LoginSucceeded(ctx context.Context, account string) error {
+	return l.Store.Reset(ctx, "login:"+account)
+}
+
+// Returns how long until a token is available in a bucket holding the given tokens
+func waitFor(tokens float64, limit Limit) time.Duration {
+	if tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - tokens) / limit.Rate() * float64(time.Second))
+}
@@ -0,0 +1,136 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimitUnmarshalText(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Limit
+	}{
+		{"10/1m", Limit{Count: 10, Period: time.Minute}},
+		{"5/s", Limit{Count: 5, Period: time.Second}},
+		{"3/15m", Limit{Count: 3, Period: 15 * time.Minute}},
+		{"0", Limit{}},
+		{"", Limit{}},
+	}
+	for _, tt := range tests {
+		var l Limit
+		if err := l.UnmarshalText([]byte(tt.in)); err != nil || l != tt.want {
+			t.Errorf("UnmarshalText(%q) = %+v, %v, want %+v", tt.in, l, err, tt.want)
+		}
+	}
+	for _, in := range []string{"10", "-1/m", "x/m", "10/0s", "10/-1m", "10/soon"} {
+		var l Limit
+		if err := l.UnmarshalText([]byte(in)); err == nil {
+			t.Errorf("UnmarshalText(%q) = %+v, want an error", in, l)
+		}
+	}
+	if s := (Limit{Count: 10, Period: time.Minute}).String(); s != "10/1m0s" {
+		t.Errorf("String = %q", s)
+	}
+}
+
+func TestLockoutDuration(t *testing.T) {
+	l := Lockout{Threshold: 3, Base: time.Minute, Max: 10 * time.Minute}
+	for failures, want := range map[int]time.Duration{
+		0:  0,
+		2:  0,
+		3:  time.Minute,
+		4:  2 * time.Minute,
+		5:  4 * time.Minute,
+		6:  8 * time.Minute,
+		7:  10 * time.Minute,
+		50: 10 * time.Minute,
+	} {
+		if got := l.Duration(failures); got != want {
+			t.Errorf("Duration(%d) = %v, want %v", failures, got, want)
+		}
+	}
+	if d := (Lockout{}).Duration(100); d != 0 {
+		t.Errorf("disabled lockout locks for %v", d)
+	}
+}
+
+func TestMemoryStoreTake(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+	limit := Limit{Count: 2, Period: time.Minute}
+	now := time.Now()
+
+	for i := 0; i < limit.Count; i++ {
+		if wait, _ := s.Take(ctx, "k", limit, now); wait != 0 {
+			t.Fatalf("request %d of the burst waits %v", i, wait)
+		}
+	}
+	// a token is refilled every 30 seconds
+	if wait, _ := s.Take(ctx, "k", limit, now); wait != 30*time.Second {
+		t.Errorf("wait after the burst = %v, want 30s", wait)
+	}
+	if wait, _ := s.Take(ctx, "k", limit, now.Add(20*time.Second)); wait != 10*time.Second {
+		t.Errorf("wait 20s later = %v, want 10s", wait)
+	}
+	if wait, _ := s.Take(ctx, "k", limit, now.Add(30*time.Second)); wait != 0 {
+		t.Errorf("refilled token not taken, wait %v", wait)
+	}
+	// the buckets of the keys are independent
+	if wait, _ := s.Take(ctx, "other", limit, now); wait != 0 {
+		t.Errorf("other key waits %v", wait)
+	}
+}
+
+func TestLimiterLockout(t *testing.T) {
+	l := &Limiter{Store: NewMemoryStore(), Lockout: Lockout{Threshold: 2, Base: time.Minute, Max: time.Hour}}
+	ctx := context.Background()
+
+	if d, _ := l.LoginFailed(ctx, "user@example.com"); d != 0 {
+		t.Fatalf("locked after the first failure for %v", d)
+	}
+	if d, _ := l.Locked(ctx, "user@example.com"); d != 0 {
+		t.Fatalf("locked for %v", d)
+	}
+	if d, _ := l.LoginFailed(ctx, "user@example.com"); d != time.Minute {
+		t.Fatalf("locked after the threshold for %v, want 1m", d)
+	}
+	if d, _ := l.Locked(ctx, "user@example.com"); d <= 0 || d > time.Minute {
+		t.Fatalf("locked for %v, want up to 1m", d)
+	}
+	if d, _ := l.Locked(ctx, "other@example.com"); d != 0 {
+		t.Fatalf("other account locked for %v", d)
+	}
+	if err := l.LoginSucceeded(ctx, "user@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := l.Locked(ctx, "user@example.com"); d != 0 {
+		t.Fatalf("still locked for %v after a successful login", d)
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+	limit := Limit{Count: 1, Period: time.Minute}
+	now := time.Now()
+	s.Take(ctx, "old", limit, now.Add(-2*time.Minute))
+	s.Take(ctx, "recent", limit, now)
+	s.Fail(ctx, "forgotten", now.Add(-FAILURE_MEMORY-time.Hour))
+	s.Fail(ctx, "locked", now.Add(-FAILURE_MEMORY-time.Hour))
+	s.Lock(ctx, "locked", now.Add(time.Hour))
+
+	s.Sweep(now)
+	if _, ok := s.buckets["old"]; ok {
+		t.Error("full bucket kept")
+	}
+	if _, ok := s.buckets["recent"]; !ok {
+		t.Error("bucket in use dropped")
+	}
+	if _, ok := s.failures["forgotten"]; ok {
+		t.Error("forgotten failures kept")
+	}
+	if _, ok := s.failures["locked"]; !ok {
+		t.Error("lock dropped before it expired")
+	}
+}
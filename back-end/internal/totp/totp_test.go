@@ -0,0 +1,97 @@
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// Secret of the SHA-1 test vectors of RFC 6238, Appendix B
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCodeRFC6238(t *testing.T) {
+	if rfcSecret != "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" {
+		t.Fatalf("secret encoded as %q", rfcSecret)
+	}
+	// the RFC gives 8 digits, the last DIGITS of them are the same code
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, v := range vectors {
+		want := v.code[len(v.code)-DIGITS:]
+		got, err := Code(rfcSecret, Step(time.Unix(v.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code at %d: %v", v.unix, err)
+		}
+		if got != want {
+			t.Errorf("Code at %d = %s, want %s", v.unix, got, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+	for offset := int64(-SKEW); offset <= SKEW; offset++ {
+		code, _ := Code(rfcSecret, step+offset)
+		got, ok := Validate(rfcSecret, code[:3]+" "+code[3:], now)
+		if !ok || got != step+offset {
+			t.Errorf("code of step %+d: Validate = %d, %v", offset, got-step, ok)
+		}
+	}
+	for _, offset := range []int64{-SKEW - 1, SKEW + 1} {
+		code, _ := Code(rfcSecret, step+offset)
+		if _, ok := Validate(rfcSecret, code, now); ok {
+			t.Errorf("code of step %+d accepted", offset)
+		}
+	}
+	for _, code := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := Validate(rfcSecret, code, now); ok {
+			t.Errorf("%q accepted", code)
+		}
+	}
+}
+
+// Callers remember the last step used and only accept codes of later steps, the way
+// the users are updated when they log in
+func TestValidateRejectsReusedStep(t *testing.T) {
+	last := int64(-1)
+	use := func(code string, now time.Time) bool {
+		step, ok := Validate(rfcSecret, code, now)
+		if !ok || step <= last {
+			return false
+		}
+		last = step
+		return true
+	}
+
+	now := time.Unix(1234567890, 0)
+	code, _ := Code(rfcSecret, Step(now))
+	if !use(code, now) {
+		t.Fatal("fresh code rejected")
+	}
+	if use(code, now) {
+		t.Error("code used twice in the same step")
+	}
+	// still within the skew, but already used
+	if use(code, now.Add(PERIOD)) {
+		t.Error("code used again in the next step")
+	}
+	// an older code is valid for the skew but its step is behind the last one used
+	older, _ := Code(rfcSecret, Step(now)-1)
+	if use(older, now) {
+		t.Error("code of an earlier step accepted after a later one")
+	}
+	next, _ := Code(rfcSecret, Step(now)+1)
+	if !use(next, now.Add(PERIOD)) {
+		t.Error("code of the next step rejected")
+	}
+}
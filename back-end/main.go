@@ -1,41 +1,374 @@
 package main
 
 import (
+	"context"
 	_ "embed"
+	"errors"
 	"flag"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	db "remindal/internal/database"
+	"remindal/internal/logging"
+	"remindal/internal/metrics"
+	"remindal/internal/tracing"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 )
 
 var (
-	router *mux.Router = mux.NewRouter()
-	port   string
+	router      *mux.Router = mux.NewRouter()
+	port        string
+	metricsPort string
+
+	readTimeout       time.Duration
+	readHeaderTimeout time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+	shutdownTimeout   time.Duration
+	logLevel          slog.Level
+	traceConfig       tracing.Config
+	// flushes the pending spans, set once tracing is set up
+	shutdownTracing = func(context.Context) error { return nil }
 )
 
+func handleHealthRoutes() {
+	router.HandleFunc("/healthz", LivenessHandler).Methods("GET")
+	router.HandleFunc("/readyz", ReadinessHandler).Methods("GET")
+}
+
 func handleUserRoutes() {
 	router.HandleFunc("/user/", GetUserHandler).Methods("GET")
 	router.HandleFunc("/user/post", PutUserHandler).Methods("POST")
 	router.HandleFunc("/user/del", DelUserHandler).Methods("DELETE")
 	router.HandleFunc("/user/list", GetUsersListHandler).Methods("GET")
+	router.HandleFunc("/user/restore", RestoreUserHandler).Methods("POST")
+	router.HandleFunc("/user/audit", GetAuditHandler).Methods("GET")
+	router.HandleFunc("/user/login", LoginHandler).Methods("POST")
+	router.HandleFunc("/user/logout", LogoutHandler).Methods("POST")
+	router.HandleFunc("/user/verify", VerifyEmailHandler).Methods("GET")
+	router.HandleFunc("/user/verify/resend", ResendVerificationHandler).Methods("POST")
+	router.HandleFunc("/user/password/forgot", ForgotPasswordHandler).Methods("POST")
+	router.HandleFunc("/user/password/reset", ResetPasswordHandler).Methods("POST")
+	router.HandleFunc("/user/password/change", ChangePasswordHandler).Methods("POST")
+	router.HandleFunc("/user/2fa/setup", SetupTOTPHandler).Methods("POST")
+	router.HandleFunc("/user/2fa/confirm", ConfirmTOTPHandler).Methods("POST")
+	router.HandleFunc("/user/2fa/disable", DisableTOTPHandler).Methods("POST")
+	router.HandleFunc("/user/2fa/reset", ResetTOTPHandler).Methods("POST")
+	router.HandleFunc("/user/apikeys", GetAPIKeysHandler).Methods("GET")
+	router.HandleFunc("/user/apikeys", PutAPIKeyHandler).Methods("POST")
+	router.HandleFunc("/user/apikeys", DelAPIKeyHandler).Methods("DELETE")
+	router.HandleFunc("/user/me", GetMeHandler).Methods("GET")
+	router.HandleFunc("/user/me", PutMeHandler).Methods("POST")
+	router.HandleFunc("/user/me/avatar", GetAvatarHandler).Methods("GET")
+	router.HandleFunc("/user/me/avatar", PutAvatarHandler).Methods("POST")
+	router.HandleFunc("/user/me/avatar", DelAvatarHandler).Methods("DELETE")
+	router.HandleFunc("/user/export", GetExportsHandler).Methods("GET")
+	router.HandleFunc("/user/export", PutExportHandler).Methods("POST")
+	router.HandleFunc("/user/export/download", DownloadExportHandler).Methods("GET")
+	router.HandleFunc("/user/oidc/login", OIDCLoginHandler).Methods("GET")
+	router.HandleFunc("/user/oidc/callback", OIDCCallbackHandler).Methods("GET")
+	router.HandleFunc("/user/oidc/link", ConfirmOIDCLinkHandler).Methods("POST")
+}
+
+func handleSettingsRoutes() {
+	router.HandleFunc("/settings/", GetSettingsHandler).Methods("GET")
+	router.HandleFunc("/settings/post", PutSettingsHandler).Methods("POST")
 }
 
 func handleDateRoutes() {
 	router.HandleFunc("/date/list", GetDateListHandler).Methods("GET")
+	router.HandleFunc("/date/stats", GetDateStatsHandler).Methods("GET")
+	router.HandleFunc("/date/upcoming", GetUpcomingDatesHandler).Methods("GET")
 	router.HandleFunc("/date/post", PutDateHandler).Methods("POST")
 	router.HandleFunc("/date/del", DelDateHandler).Methods("DELETE")
 }
 
-func main() {
+func handleCalendarRoutes() {
+	router.HandleFunc("/calendar/month/{year:[0-9]+}/{month:[0-9]+}", GetMonthViewHandler).Methods("GET")
+	router.HandleFunc("/calendar/week/{isoYear:[0-9]+}/{week:[0-9]+}", GetWeekViewHandler).Methods("GET")
+	router.HandleFunc("/calendar/day/{year:[0-9]+}/{month:[0-9]+}/{day:[0-9]+}", GetDayViewHandler).Methods("GET")
+}
+
+func parseFlags() {
 	flag.StringVar(&port, "port", ":8080", "The port the server will use to listen to requests")
+	flag.TextVar(&logLevel, "log-level", slog.LevelInfo, "Minimum level of the logged records: DEBUG, INFO, WARN or ERROR")
+	flag.DurationVar(&readTimeout, "read-timeout", 15*time.Second, "Maximum time to read a whole request, body included")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", 5*time.Second, "Maximum time to read the headers of a request")
+	flag.DurationVar(&writeTimeout, "write-timeout", 30*time.Second, "Maximum time to write a response")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 2*time.Minute, "Maximum time a keep-alive connection waits for the next request")
+	flag.IntVar(&maxHeaderBytes, "max-header-bytes", 64<<10, "Maximum size of the headers of a request")
+	flag.StringVar(&tlsCert, "tls-cert", "", "Certificate file to serve HTTPS with, HTTPS is disabled when empty")
+	flag.StringVar(&tlsKey, "tls-key", "", "Private key file of the TLS certificate")
+	flag.DurationVar(&tlsReloadInterval, "tls-reload-interval", time.Minute, "How often the TLS certificate and key files are checked for changes")
+	flag.StringVar(&metricsPort, "metrics-port", ":9090", "Port of the internal listener serving the Prometheus metrics, disabled when empty")
+	flag.StringVar(&redirectPort, "redirect-port", "", "Port of a plain HTTP listener redirecting to HTTPS, disabled when empty")
+	flag.DurationVar(&hstsMaxAge, "hsts-max-age", 180*24*time.Hour, "Max age of the HSTS header sent over HTTPS, disabled when 0")
+	flag.BoolVar(&hstsSubdomains, "hsts-include-subdomains", false, "Whether the HSTS header also covers the subdomains, which must all serve HTTPS")
+	flag.StringVar(&environment, "env", ENV_DEVELOPMENT, "Environment the server runs in: development, staging or production")
+	flag.StringVar(&corsOrigins, "cors-origins", "", "Comma separated origins allowed to make cross-origin requests, the ones of the environment when empty")
+	flag.StringVar(&corsMethods, "cors-methods", "GET,POST,DELETE", "Comma separated methods allowed in cross-origin requests")
+	flag.StringVar(&corsHeaders, "cors-headers", "Content-Type,Accept-Language,Authorization,X-Request-ID", "Comma separated headers allowed in cross-origin requests")
+	flag.BoolVar(&corsCredentials, "cors-credentials", false, "Whether cross-origin requests can include credentials")
+	flag.DurationVar(&corsMaxAge, "cors-max-age", 10*time.Minute, "How long browsers can cache the result of a preflight request")
+	flag.DurationVar(&sessionTTL, "session-ttl", 7*24*time.Hour, "How long a session lasts after logging in")
+	flag.StringVar(&admins, "admins", "", "Comma separated emails of registered users to promote to admins on startup")
+	flag.StringVar(&orphanDatesOwner, "orphan-dates-owner", "", "Email of the registered user the dates without an owner are given to on startup")
+	flag.StringVar(&mailer, "mailer", MAILER_LOG, "How the emails are delivered: log, to only log them in development, or smtp")
+	flag.StringVar(&smtpAddr, "smtp-addr", "", "host:port of the SMTP server, its password is read from "+SMTP_PASSWORD_ENV)
+	flag.StringVar(&smtpUser, "smtp-username", "", "Username of the SMTP server, no authentication when empty")
+	flag.StringVar(&mailFrom, "mail-from", "", "Sender address of the emails")
+	flag.StringVar(&publicURL, "public-url", "http://localhost:8080", "URL the server is reached at by users, used in the links sent by email")
+	flag.DurationVar(&verifyTokenTTL, "verify-token-ttl", 48*time.Hour, "How long an email verification link is valid")
+	flag.DurationVar(&unverifiedTTL, "unverified-ttl", 7*24*time.Hour, "How long after signing up unverified users are deleted, 0 keeps them")
+	flag.TextVar(&verifyResendLimit, "verify-resend-limit", verifyResendLimit, "Verification emails that can be sent to an address as count/period")
+	flag.DurationVar(&resetTokenTTL, "reset-token-ttl", 30*time.Minute, "How long a password reset link is valid")
+	flag.StringVar(&resetPasswordURL, "reset-password-url", "", "URL of the client page the password reset links open, given the token in the query, password reset is disabled when empty")
+	flag.TextVar(&resetRequestLimit, "reset-request-limit", resetRequestLimit, "Password reset emails that can be sent to an address as count/period")
+	flag.StringVar(&oidcIssuer, "oidc-issuer", "", "Issuer URL of the OpenID Connect provider users can log in with, single sign-on is disabled when empty")
+	flag.StringVar(&oidcClientID, "oidc-client-id", "", "Client ID registered at the OpenID Connect provider, its secret is read from "+OIDC_CLIENT_SECRET_ENV)
+	flag.StringVar(&oidcRedirectURL, "oidc-redirect-url", "", "Callback URL registered at the OpenID Connect provider, the one of -public-url when empty")
+	flag.StringVar(&oidcReturnURL, "oidc-return-url", "", "URL of the client users are sent to with their session after logging in, the session is written as JSON when empty")
+	flag.BoolVar(&oidcCreateUsers, "oidc-create-users", true, "Whether users logging in with the OpenID Connect provider for the first time are registered")
+	flag.DurationVar(&deletionGrace, "deletion-grace", 30*24*time.Hour, "How long a deleted account can be restored by logging in before its data is erased")
+	flag.StringVar(&exportDir, "export-dir", "exports", "Directory the exports of personal data are prepared in")
+	flag.DurationVar(&exportTTL, "export-ttl", 24*time.Hour, "How long the download link of an export of personal data is valid")
+	flag.TextVar(&exportRequestLimit, "export-request-limit", exportRequestLimit, "Exports of personal data a user can ask for as count/period")
+	flag.StringVar(&avatarDir, "avatar-dir", "avatars", "Directory the avatars of the users are stored in")
+	flag.Int64Var(&maxAvatarBytes, "max-avatar-bytes", 1<<20, "Maximum size of an uploaded avatar")
+	flag.TextVar(&rateLimit, "rate-limit", rateLimit, "Requests allowed per client as count/period, e.g. 300/1m, 0 disables the limit")
+	flag.TextVar(&authRateLimit, "auth-rate-limit", authRateLimit, "Requests to the user routes allowed per client as count/period")
+	flag.TextVar(&accountRateLimit, "account-rate-limit", accountRateLimit, "Requests to the user routes allowed per account as count/period")
+	flag.IntVar(&limiter.Lockout.Threshold, "lockout-threshold", limiter.Lockout.Threshold, "Failed logins before an account is locked, 0 disables the lockout")
+	flag.DurationVar(&limiter.Lockout.Base, "lockout-base", limiter.Lockout.Base, "Duration of the first lock, doubled at every further failed login")
+	flag.DurationVar(&limiter.Lockout.Max, "lockout-max", limiter.Lockout.Max, "Maximum duration of a lock")
+	flag.StringVar(&rateStore, "rate-limit-store", RATE_STORE_MEMORY, "Where the rate limiting counters are kept: memory, or database to share them between instances")
+	flag.IntVar(&trustedProxies, "trusted-proxies", 0, "Number of proxies in front of the server appending to the X-Forwarded-For header, 0 when the client connects directly")
+	flag.DurationVar(&shutdownDelay, "shutdown-delay", 0, "How long readiness fails before the server stops accepting connections on shutdown")
+	flag.DurationVar(&readyTimeout, "ready-timeout", 2*time.Second, "Maximum time the database can take to answer a readiness probe")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "Maximum time to wait for in-flight requests and background workers on shutdown")
+	flag.StringVar(&traceConfig.Exporter, "trace-exporter", tracing.EXPORTER_NONE, "Where the spans are exported: none, stdout or otlp")
+	flag.StringVar(&traceConfig.Endpoint, "otlp-endpoint", "", "host:port of the OTLP/HTTP collector, the OTEL_EXPORTER_OTLP_* variables apply when empty")
+	flag.BoolVar(&traceConfig.Insecure, "otlp-insecure", false, "Whether the OTLP collector is reached over plain HTTP")
+	flag.Float64Var(&traceConfig.SampleRatio, "trace-sample-ratio", 1, "Fraction of the traces started by the server that are sampled")
+	flag.DurationVar(&db.OpTimeouts.Connect, "db-connect-timeout", db.OpTimeouts.Connect, "Maximum time to connect to the database")
+	flag.DurationVar(&db.OpTimeouts.Read, "db-read-timeout", db.OpTimeouts.Read, "Maximum time of a database read")
+	flag.DurationVar(&db.OpTimeouts.Write, "db-write-timeout", db.OpTimeouts.Write, "Maximum time of a database write")
+	flag.DurationVar(&db.OpTimeouts.Aggregate, "db-aggregate-timeout", db.OpTimeouts.Aggregate, "Maximum time of a database aggregation")
 	flag.Parse()
+}
+
+// Logs the error and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// Fails readiness for the shutdown delay, so that no new traffic is routed to the server.
+// Then stops accepting connections and waits for the in-flight requests, stops the
+// background workers, closes the database and flushes the pending spans, all within
+// the shutdown timeout.
+func shutdown(servers ...*http.Server) {
+	shuttingDown.Store(true)
+	time.Sleep(shutdownDelay)
 
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("shutdown - server.Shutdown", "err", err)
+		}
+	}
+	if err := workers.Stop(ctx); err != nil {
+		slog.Error("shutdown - workers.Stop", "err", err)
+	}
+	if err := db.Disconnect(ctx); err != nil {
+		slog.Error("shutdown - db.Disconnect", "err", err)
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("shutdown - shutdownTracing", "err", err)
+	}
+}
+
+// Runs the operation until it succeeds or the context is done, waiting between the
+// attempts for a time doubling every failure
+func retry(ctx context.Context, name string, op func(ctx context.Context) error) {
+	backoff := time.Second
+	for {
+		err := op(ctx)
+		if err == nil {
+			return
+		}
+		slog.Error("retry - "+name, "err", err, "retry_in", backoff.String())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, time.Minute)
+	}
+}
+
+// Creates the indexes, retrying until they are created. Readiness fails until then.
+func ensureIndexes(ctx context.Context) {
+	retry(ctx, "db.EnsureIndexes", db.EnsureIndexes)
+}
+
+// Returns a server with the configured timeouts and limits
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       readTimeout,
+		ReadHeaderTimeout: readHeaderTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
+}
+
+func main() {
+	parseFlags()
+	slog.SetDefault(slog.New(logging.NewHandler(os.Stdout, logLevel)))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	flush, err := tracing.Setup(ctx, traceConfig)
+	if err != nil {
+		fatal("main - tracing.Setup", err)
+	}
+	shutdownTracing = flush
+
+	if err := db.Connect(ctx); err != nil {
+		fatal("main - db.Connect", err)
+	}
+	workers.Go("indexes", ensureIndexes)
+	workers.Go("normalize-emails", normalizeEmails)
+	if admins != "" {
+		workers.Go("promote-admins", promoteAdmins)
+	}
+	if orphanDatesOwner != "" {
+		workers.Go("adopt-orphan-dates", adoptOrphanDates)
+	}
+
+	corsOpts, err := newCorsOptions()
+	if err != nil {
+		fatal("main - newCorsOptions", err)
+	}
+
+	if err := newRateLimiter(); err != nil {
+		fatal("main - newRateLimiter", err)
+	}
+	if err := newMailSender(); err != nil {
+		fatal("main - newMailSender", err)
+	}
+	if err := newOIDCProvider(); err != nil {
+		fatal("main - newOIDCProvider", err)
+	}
+	if err := ensureAvatarDir(); err != nil {
+		fatal("main - ensureAvatarDir", err)
+	}
+	if err := ensureExportDir(); err != nil {
+		fatal("main - ensureExportDir", err)
+	}
+	requiredWorkers = append(requiredWorkers, "purge-exports")
+	workers.Go("purge-exports", func(ctx context.Context) {
+		purgeExports(ctx, time.Hour)
+	})
+	requiredWorkers = append(requiredWorkers, "purge-deleted")
+	workers.Go("purge-deleted", func(ctx context.Context) {
+		purgeDeleted(ctx, time.Hour)
+	})
+	workers.Go("refresh-ages", func(ctx context.Context) {
+		refreshAges(ctx, time.Hour)
+	})
+	if unverifiedTTL > 0 {
+		requiredWorkers = append(requiredWorkers, "purge-unverified")
+		workers.Go("purge-unverified", func(ctx context.Context) {
+			purgeUnverified(ctx, time.Hour)
+		})
+	}
+
+	router.Use(traceRequests, logRequests, measureRequests, limitRequests, authorize)
+	router.NotFoundHandler = traceRequests(logRequests(measureRequests(limitRequests(http.NotFoundHandler()))))
+	router.MethodNotAllowedHandler = traceRequests(logRequests(measureRequests(limitRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	})))))
+	handleHealthRoutes()
 	handleUserRoutes()
+	handleSettingsRoutes()
 	handleDateRoutes()
+	handleCalendarRoutes()
+
+	var (
+		handler = cors.New(corsOpts).Handler(router)
+		servers []*http.Server
+		errc    = make(chan error, 3)
+	)
+	// kept off the public listener, the metrics reveal the traffic of every route
+	if metricsPort != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		server := newServer(metricsPort, mux)
+		servers = append(servers, server)
+		go func() {
+			slog.Info("metrics will be served", "port", metricsPort)
+			errc <- server.ListenAndServe()
+		}()
+	}
+	if tlsCert == "" {
+		server := newServer(port, handler)
+		servers = append(servers, server)
+		go func() {
+			slog.Info("server will be listening", "port", port)
+			errc <- server.ListenAndServe()
+		}()
+	} else {
+		cr, err := newCertReloader(tlsCert, tlsKey)
+		if err != nil {
+			fatal("main - newCertReloader", err)
+		}
+		requiredWorkers = append(requiredWorkers, "tls-reload")
+		workers.Go("tls-reload", func(ctx context.Context) {
+			cr.watch(ctx, tlsReloadInterval)
+		})
+
+		if hstsMaxAge > 0 {
+			handler = hsts(handler)
+		}
+		server := newServer(port, handler)
+		server.TLSConfig = newTLSConfig(cr)
+		servers = append(servers, server)
+		go func() {
+			slog.Info("server will be listening for HTTPS", "port", port)
+			errc <- server.ListenAndServeTLS("", "")
+		}()
+
+		if redirectPort != "" {
+			redirect := newServer(redirectPort, http.HandlerFunc(redirectToHTTPS))
+			servers = append(servers, redirect)
+			go func() {
+				slog.Info("server will be redirecting to HTTPS", "port", redirectPort)
+				errc <- redirect.ListenAndServe()
+			}()
+		}
+	}
 
-	handler := cors.Default().Handler(router)
-	log.Print("server will be listening on port ", port)
-	log.Fatal(http.ListenAndServe(port, handler))
+	select {
+	case err := <-errc:
+		if !errors.Is(err, http.ErrServerClosed) {
+			fatal("main - server.ListenAndServe", err)
+		}
+	case <-ctx.Done():
+		slog.Info("shutting down")
+		stop()
+		shutdown(servers...)
+	}
 }
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"remindal/internal/logging"
+	"remindal/internal/metrics"
+	"remindal/internal/tracing"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+// Request IDs received from clients are only propagated if they are made of these characters
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// Wraps a ResponseWriter to record the status and the size of the response. The
+// recorder of the logging middleware also carries the logger of the request, for the
+// failures to write the response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+	log    *slog.Logger
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := rr.ResponseWriter.Write(b)
+	rr.bytes += n
+	return n, err
+}
+
+// Flushes the buffered response if the wrapped ResponseWriter supports it, e.g. to
+// stream the response
+func (rr *responseRecorder) Flush() {
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		if rr.status == 0 {
+			rr.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+// Returns the wrapped ResponseWriter, so that [http.ResponseController] reaches the
+// features of the underlying one
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// Records the status on the recorders wrapping the ResponseWriter without writing it,
+// for the logs and metrics of the responses that are never sent
+func recordStatus(w http.ResponseWriter, status int) {
+	for {
+		if rr, ok := w.(*responseRecorder); ok && rr.status == 0 {
+			rr.status = status
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = u.Unwrap()
+	}
+}
+
+// Returns the logger of the request the ResponseWriter responds to, the default one if
+// the request did not go through the logging middleware
+func writerLogger(w http.ResponseWriter) *slog.Logger {
+	for {
+		if rr, ok := w.(*responseRecorder); ok && rr.log != nil {
+			return rr.log
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return slog.Default()
+		}
+		w = u.Unwrap()
+	}
+}
+
+// Returns the ID the client sent along with the request if valid, a new random one otherwise
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(REQUEST_ID_HEADER); validRequestID.MatchString(id) {
+		return id
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		slog.Error("requestID - rand.Read", "err", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Returns the logger of the request, carrying its ID
+func logger(r *http.Request) *slog.Logger {
+	return logging.FromContext(r.Context())
+}
+
+// Returns the route template matched by the request, empty if no route matched
+func routeTemplate(r *http.Request) string {
+	current := mux.CurrentRoute(r)
+	if current == nil {
+		return ""
+	}
+	route, _ := current.GetPathTemplate()
+	return route
+}
+
+// Middleware starting a span for every request, named after the matched route template.
+// The span continues the trace of the client if the request carries a W3C trace context.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		route := routeTemplate(r)
+		name := r.Method
+		if route != "" {
+			name += " " + route
+		}
+		ctx, span := tracing.Tracer().Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+				semconv.ClientAddress(r.RemoteAddr),
+				semconv.UserAgentOriginal(r.UserAgent()),
+			),
+		)
+		defer span.End()
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// Middleware assigning an ID to every request, sent back in the X-Request-ID header.
+// Handlers and the database layer log through a logger carrying the ID, and the trace
+// ID if the request is traced. Once the request is served its outcome is logged.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			start = time.Now()
+			id    = requestID(r)
+			log   = slog.Default().With("request_id", id)
+		)
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			log = log.With("trace_id", sc.TraceID().String())
+		}
+		rec := &responseRecorder{ResponseWriter: w, log: log}
+		w.Header().Set(REQUEST_ID_HEADER, id)
+		next.ServeHTTP(rec, r.WithContext(logging.WithLogger(r.Context(), log)))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		log.Info("request",
+			"method", r.Method,
+			"route", routeTemplate(r),
+			"path", r.URL.Path,
+			"query", logging.RedactQuery(r.URL.Query()),
+			"status", rec.status,
+			"latency_ms", float64(time.Since(start).Microseconds())/1000,
+			"bytes", rec.bytes,
+			"remote", r.RemoteAddr,
+		)
+	})
+}
+
+// Middleware recording the number, latency and status of the requests by route template.
+// Requests that match no route are grouped together, so that unknown paths do not
+// create new series.
+func measureRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics.HttpInFlight.Inc()
+		defer metrics.HttpInFlight.Dec()
+
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		route := routeTemplate(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		status := strconv.Itoa(rec.status)
+		metrics.HttpRequests.WithLabelValues(route, r.Method, status).Inc()
+		metrics.HttpDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	db "remindal/internal/database"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Records the spans ended during the test in memory, continuing the W3C trace context
+// of the requests
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		otel.SetTextMapPropagator(propagator)
+		provider.Shutdown(context.Background())
+	})
+	return exporter
+}
+
+// Middleware logging in every request as the principal
+func withPrincipal(p *Principal) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+		})
+	}
+}
+
+func findSpan(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	t.Helper()
+	for _, s := range spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	names := make([]string, len(spans))
+	for i, s := range spans {
+		names[i] = s.Name
+	}
+	t.Fatalf("no span %q among %v", name, names)
+	return tracetest.SpanStub{}
+}
+
+func attr(s tracetest.SpanStub, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range s.Attributes {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestTraceRequests(t *testing.T) {
+	exporter := recordSpans(t)
+	router := mux.NewRouter()
+	router.Use(traceRequests, logRequests, withPrincipal(&Principal{Email: "user@example.com", Role: ROLE_USER}))
+	router.HandleFunc("/date/list", GetDateListHandler).Methods("GET")
+
+	// the client's trace is continued
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest("GET", "/date/list?type=birthday&labels=work,home&minyear=2000", nil)
+	req.Header.Set("traceparent", parent)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	spans := exporter.GetSpans()
+	server := findSpan(t, spans, "GET /date/list")
+	if server.SpanKind != trace.SpanKindServer {
+		t.Errorf("request span kind = %v", server.SpanKind)
+	}
+	if got := server.SpanContext.TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("request span in trace %s, want the one of the client", got)
+	}
+	if v, _ := attr(server, semconv.HTTPRouteKey); v.AsString() != "/date/list" {
+		t.Errorf("http.route = %q", v.AsString())
+	}
+	if v, _ := attr(server, semconv.HTTPResponseStatusCodeKey); v.AsInt64() != int64(rec.Code) {
+		t.Errorf("http.response.status_code = %d, response was %d", v.AsInt64(), rec.Code)
+	}
+
+	db := findSpan(t, spans, "find remindalDB.calendar")
+	if db.SpanKind != trace.SpanKindClient {
+		t.Errorf("database span kind = %v", db.SpanKind)
+	}
+	if db.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Error("database span is not a child of the request span")
+	}
+	if v, _ := attr(db, semconv.DBOperationKey); v.AsString() != "find" {
+		t.Errorf("db.operation = %q", v.AsString())
+	}
+	statement, ok := attr(db, semconv.DBStatementKey)
+	if !ok {
+		t.Fatal("database span has no db.statement")
+	}
+	want := `{"$and":[{"$or":[{"labels":"?"}]}],"type":"?","year":{"$gte":"?"},"owner":"?"}`
+	if statement.AsString() != want {
+		t.Errorf("db.statement = %s, want %s", statement.AsString(), want)
+	}
+	for _, value := range []string{"birthday", "work", "home", "2000", "user@example.com"} {
+		if strings.Contains(statement.AsString(), value) {
+			t.Errorf("db.statement leaks %q", value)
+		}
+	}
+}
+
+func TestResponseRecorder(t *testing.T) {
+	var logs bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	handler := logRequests(measureRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("the recorder does not implement http.Flusher")
+		}
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Errorf("ResponseController.Flush = %v", err)
+		}
+		// channels cannot be marshalled
+		Okres(w, make(chan int))
+	})))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(REQUEST_ID_HEADER, "req-1")
+	handler.ServeHTTP(w, r)
+
+	if !w.Flushed {
+		t.Error("the response was not flushed")
+	}
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record["msg"] == "res.Ok - json.Marshal" {
+			found = true
+			if record["request_id"] != "req-1" {
+				t.Errorf("failure to respond logged without the request ID: %s", line)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("failure to respond not logged: %s", logs.String())
+	}
+}
+
+func TestCanceledRequestNotAnswered(t *testing.T) {
+	var logs bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	handler := logRequests(measureRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Eres(w, ErrFrom(fmt.Errorf("%w: %w", db.ErrCanceled, context.Canceled)))
+	})))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Body.Len() != 0 || w.Code == STATUS_CLIENT_CLOSED_REQUEST {
+		t.Errorf("response written to a canceled request: %d %s", w.Code, w.Body)
+	}
+	if !strings.Contains(logs.String(), `"status":499`) {
+		t.Errorf("canceled request not logged with status 499: %s", logs.String())
+	}
+}
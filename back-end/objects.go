@@ -1,21 +1,228 @@
 package main
 
 import (
+	"reflect"
+	"strings"
 	"time"
+	// the time zones of the preferences are validated even where the system has no tz database
+	_ "time/tzdata"
+	"unicode/utf8"
 
 	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type User struct {
-	Email    string `bson:"_id" json:"_id,omitempty" validate:"required,email"`
-	Password string `bson:"password" json:"password,omitempty" validate:"required"`
+	Email string `bson:"_id" json:"_id,omitempty" validate:"required,email"`
+	// bcrypt hash once stored
+	Password string `bson:"password" json:"password,omitempty" validate:"required,password_policy"`
 	Name     string `bson:"name" json:"name,omitempty" validate:"required"`
 	Surname  string `bson:"surname" json:"surname,omitempty" validate:"required"`
-	Age      uint8  `bson:"age,omitempty" json:"age,omitempty"`
+	// computed from the birth date when there is one, kept up to date by refreshAges
+	Age uint8 `bson:"age,omitempty" json:"age,omitempty"`
+	// as YYYY-MM-DD
+	BirthDate   string       `bson:"birthDate,omitempty" json:"birthDate,omitempty" validate:"omitempty,birth_date"`
+	Preferences *Preferences `bson:"preferences,omitempty" json:"preferences,omitempty"`
+	// file name of the avatar in the avatar directory, never sent nor read from clients
+	Avatar    string `bson:"avatar,omitempty" json:"-"`
+	HasAvatar bool   `bson:"-" json:"hasAvatar,omitempty"`
+	Role      string `bson:"role,omitempty" json:"role,omitempty" validate:"omitempty,oneof=user admin"`
+	// set until the user confirms the email, users registered before verification was introduced count as verified
+	Unverified bool      `bson:"unverified,omitempty" json:"unverified,omitempty"`
+	CreatedAt  time.Time `bson:"createdAt,omitempty" json:"createdAt,omitempty"`
+
+	// two-factor authentication, never sent nor read from clients
+	TOTPEnabled bool   `bson:"totpEnabled,omitempty" json:"-"`
+	TOTPSecret  string `bson:"totpSecret,omitempty" json:"-"`
+	// secret generated at enrollment, until it is confirmed with a first code
+	TOTPPending string `bson:"totpPending,omitempty" json:"-"`
+	// time step of the last code used, codes of that step or earlier are rejected
+	TOTPLastStep  int64    `bson:"totpLastStep,omitempty" json:"-"`
+	RecoveryCodes []string `bson:"recoveryCodes,omitempty" json:"-"`
+
+	// subject of the account of the OpenID Connect provider the user logs in with
+	OIDCSubject string `bson:"oidcSubject,omitempty" json:"-"`
+
+	// set when the user asked to delete the account, which can be restored until then
+	DeleteAt *time.Time `bson:"deleteAt,omitempty" json:"deleteAt,omitempty"`
+	// set once the deletion started, the account cannot be restored anymore
+	Purging bool `bson:"purging,omitempty" json:"-"`
+}
+
+// Returns the user as it can be sent to clients, without the password hash
+func (u User) Public() User {
+	u.Password = ""
+	if birth, err := time.Parse(DATE_LAYOUT, u.BirthDate); err == nil {
+		u.Age = ageOn(birth, time.Now())
+	}
+	u.HasAvatar = u.Avatar != ""
+	return u
+}
+
+// Settings of a user, applied by the clients
+type Preferences struct {
+	// IANA name, e.g. Europe/Rome
+	TimeZone string `bson:"timeZone,omitempty" json:"timeZone,omitempty" validate:"omitempty,timezone"`
+	// BCP 47 tag, e.g. it-IT
+	Locale       string `bson:"locale,omitempty" json:"locale,omitempty" validate:"omitempty,bcp47_language_tag"`
+	FirstWeekday string `bson:"firstWeekday,omitempty" json:"firstWeekday,omitempty" validate:"omitempty,oneof=monday tuesday wednesday thursday friday saturday sunday"`
+	// minutes before a date its reminders are sent by default
+	ReminderOffsets []int `bson:"reminderOffsets,omitempty" json:"reminderOffsets,omitempty" validate:"max=5,unique,dive,min=0,max=40320"`
+}
+
+// Changes of the profile of the logged in user, empty fields are left unchanged
+type ProfileUpdate struct {
+	Name      string `json:"name,omitempty" validate:"omitempty,max=64"`
+	Surname   string `json:"surname,omitempty" validate:"omitempty,max=64"`
+	BirthDate string `json:"birthDate,omitempty" validate:"omitempty,birth_date"`
+	// replaces every preference when present
+	Preferences *Preferences `json:"preferences,omitempty"`
+}
+
+// Email and password sent to log in
+type Credentials struct {
+	Email    string `json:"_id" validate:"required,email"`
+	Password string `json:"password" validate:"required"`
+	// code of the authenticator app or recovery code, required if two-factor authentication is enabled
+	Code string `json:"code,omitempty"`
+}
+
+// Email address a link is sent to
+type EmailRequest struct {
+	Email string `json:"_id" validate:"required,email"`
+}
+
+// Token received by email and the new password to set with it
+type PasswordReset struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,password_policy"`
+}
+
+// Current password of a logged in user and the new one replacing it
+type PasswordChange struct {
+	OldPassword string `json:"oldPassword" validate:"required"`
+	NewPassword string `json:"newPassword" validate:"required,password_policy,nefield=OldPassword"`
+}
+
+// Secret generated to enroll an authenticator app, along with its otpauth URI
+type TOTPSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// Code of the authenticator app, or a recovery code
+type TOTPCode struct {
+	Code string `json:"code" validate:"required"`
+}
+
+// Personal API key of a user. Only the hash of the key is stored, the key itself is
+// only shown once when created.
+type APIKey struct {
+	ID string `bson:"_id" json:"-"`
+	// first characters of the key, telling keys apart without revealing them
+	Prefix     string     `bson:"prefix" json:"prefix"`
+	User       string     `bson:"user" json:"-"`
+	Name       string     `bson:"name" json:"name" validate:"required,max=64"`
+	Scopes     []string   `bson:"scopes" json:"scopes" validate:"required,min=1,dive,oneof=dates:read dates:write users:manage"`
+	CreatedAt  time.Time  `bson:"createdAt" json:"createdAt"`
+	ExpiresAt  *time.Time `bson:"expireAt,omitempty" json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `bson:"lastUsedAt,omitempty" json:"lastUsedAt,omitempty"`
+	Key        string     `bson:"-" json:"key,omitempty"`
+}
+
+// Single use token sent by email to prove the ownership of the address. Only the hash
+// of the token is stored.
+type EmailToken struct {
+	ID        string    `bson:"_id"`
+	Kind      string    `bson:"kind"`
+	User      string    `bson:"user"`
+	ExpiresAt time.Time `bson:"expireAt"`
+}
+
+// Login started at the OpenID Connect provider, until the user is sent back. Stored
+// along with the email tokens, by the hash of its state.
+type OIDCLogin struct {
+	ID        string    `bson:"_id"`
+	Kind      string    `bson:"kind"`
+	Nonce     string    `bson:"nonce"`
+	Verifier  string    `bson:"verifier"`
+	ExpiresAt time.Time `bson:"expireAt"`
+}
+
+// Link of an account of the OpenID Connect provider to a user with two-factor
+// authentication, waiting for a code of the user. Stored along with the email tokens,
+// by the hash of its token.
+type OIDCLink struct {
+	ID        string    `bson:"_id"`
+	Kind      string    `bson:"kind"`
+	User      string    `bson:"user"`
+	Subject   string    `bson:"subject"`
+	ExpiresAt time.Time `bson:"expireAt"`
+}
+
+// Token of a pending link, sent to the client instead of a session
+type OIDCPendingLink struct {
+	LinkToken string    `json:"linkToken"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Token of a pending link and the code of the user confirming it
+type OIDCLinkConfirmation struct {
+	LinkToken string `json:"linkToken" validate:"required"`
+	Code      string `json:"code" validate:"required"`
+}
+
+// Archive with every piece of data of a user. Stored by the hash of the token of its
+// download link.
+type DataExport struct {
+	ID        string    `bson:"_id" json:"-"`
+	User      string    `bson:"user" json:"-"`
+	Status    string    `bson:"status" json:"status"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	ExpiresAt time.Time `bson:"expireAt" json:"expiresAt"`
+	// download link, only known when the export is asked for
+	URL string `bson:"-" json:"url,omitempty"`
+}
+
+// When the account of a user will be deleted
+type DeletionSchedule struct {
+	DeleteAt time.Time `json:"deleteAt"`
+}
+
+// Action recorded in the audit trail
+type AuditEntry struct {
+	ID primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	// hash of the email of the user the action is about, so that the trail outlives
+	// the personal data of deleted users
+	User   string `bson:"user" json:"-"`
+	Action string `bson:"action" json:"action"`
+	// email of whoever acted on someone else's account, AUDIT_SELF or AUDIT_SYSTEM
+	Actor   string         `bson:"actor" json:"actor"`
+	At      time.Time      `bson:"at" json:"at"`
+	Details map[string]any `bson:"details,omitempty" json:"details,omitempty"`
+}
+
+// Settings of the whole application, changed by admins
+type Settings struct {
+	// only admins can log in with a password, everyone else logs in with the OpenID
+	// Connect provider
+	PasswordLoginDisabled bool `bson:"passwordLoginDisabled" json:"passwordLoginDisabled"`
+}
+
+// Session of a logged in user. Only the hash of the token is stored, the token itself
+// is only known to the client.
+type Session struct {
+	ID        string    `bson:"_id" json:"-"`
+	User      string    `bson:"user" json:"-"`
+	CreatedAt time.Time `bson:"createdAt" json:"-"`
+	ExpiresAt time.Time `bson:"expireAt" json:"expiresAt"`
+	Token     string    `bson:"-" json:"token"`
 }
 
 type Date struct {
 	ID string `bson:"_id,omitempty" json:"_id,omitempty"`
+	// email of the user who created the date, set by the server
+	Owner string `bson:"owner,omitempty" json:"owner,omitempty"`
 
 	Labels []string `bson:"labels,omitempty" json:"labels,omitempty"`
 	Type   string   `bson:"type" json:"type" validate:"required"`
@@ -48,10 +255,68 @@ func dayValidation(fl validator.FieldLevel) bool {
 	return true
 }
 
-// returns a new validator with registered custom validators for the object Date
-func newCustomDateValidator() *validator.Validate {
+// Bounds of the length of a password. bcrypt ignores anything past 72 bytes.
+const (
+	MIN_PASSWORD_CHARS = 8
+	MAX_PASSWORD_BYTES = 72
+)
+
+// Checks that the password is at least MIN_PASSWORD_CHARS characters long and that
+// it fits in MAX_PASSWORD_BYTES bytes, so that no part of it is ignored when hashed
+func passwordPolicy(fl validator.FieldLevel) bool {
+	p := fl.Field().String()
+	return utf8.RuneCountInString(p) >= MIN_PASSWORD_CHARS && len(p) <= MAX_PASSWORD_BYTES
+}
+
+// Layout of the dates without time, e.g. the birth dates
+const DATE_LAYOUT = time.DateOnly
+
+// Oldest age a birth date can give
+const MAX_AGE_YEARS = 150
+
+// Checks that the birth date is a YYYY-MM-DD date in the past, at most MAX_AGE_YEARS ago
+func birthDate(fl validator.FieldLevel) bool {
+	t, err := time.Parse(DATE_LAYOUT, fl.Field().String())
+	if err != nil {
+		return false
+	}
+	now := time.Now().UTC()
+	return t.Before(now) && t.After(now.AddDate(-MAX_AGE_YEARS, 0, 0))
+}
+
+// Returns the age at the instant of someone born on the birth date
+func ageOn(birth, now time.Time) uint8 {
+	age := now.Year() - birth.Year()
+	if now.Month() < birth.Month() || (now.Month() == birth.Month() && now.Day() < birth.Day()) {
+		age--
+	}
+	return uint8(max(age, 0))
+}
+
+// The validator is safe for concurrent use and caches the structs it validates,
+// so it is shared by every request. Translations are registered on a single
+// universal translator, which is why there is only one instance.
+var validate = newValidator()
+
+// returns a new validator that reports the fields by their JSON name, with registered
+// custom validators for the dates, the passwords and the birth dates, and messages translated in every supported language
+func newValidator() *validator.Validate {
 	validate := validator.New()
+	validate.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
 	validate.RegisterValidation("day_validation", dayValidation)
+	validate.RegisterValidation("password_policy", passwordPolicy)
+	validate.RegisterValidation("birth_date", birthDate)
+
+	registerDefaultTranslations(validate)
+	registerCustomTranslation(validate, "day_validation")
+	registerCustomTranslation(validate, "password_policy")
+	registerCustomTranslation(validate, "birth_date")
 	return validate
 }
 
@@ -59,3 +324,46 @@ type Calendar struct {
 	Alias string `bson:"alias"`
 	Dates []Date `bson:"dates"`
 }
+
+// Number of dates sharing the same key
+type GroupCount struct {
+	Key   string `bson:"_id" json:"key"`
+	Count int    `bson:"count" json:"count"`
+}
+
+// Number of dates in the same month of the same year
+type MonthCount struct {
+	Year  int16 `bson:"year" json:"year"`
+	Month int8  `bson:"month" json:"month"`
+	Count int   `bson:"count" json:"count"`
+}
+
+type DateStats struct {
+	ByType       []GroupCount `bson:"byType" json:"byType"`
+	ByLabel      []GroupCount `bson:"byLabel" json:"byLabel"`
+	ByMonth      []MonthCount `bson:"byMonth" json:"byMonth"`
+	ByWeekday    []GroupCount `bson:"byWeekday" json:"byWeekday"`
+	BusiestMonth *MonthCount  `bson:"busiestMonth,omitempty" json:"busiestMonth,omitempty"`
+	NextPerType  []Date       `bson:"nextPerType" json:"nextPerType"`
+}
+
+// Returns the statistics with empty lists in place of the missing ones, so that clients
+// always receive arrays
+func (s DateStats) WithEmptyLists() DateStats {
+	if s.ByType == nil {
+		s.ByType = []GroupCount{}
+	}
+	if s.ByLabel == nil {
+		s.ByLabel = []GroupCount{}
+	}
+	if s.ByMonth == nil {
+		s.ByMonth = []MonthCount{}
+	}
+	if s.ByWeekday == nil {
+		s.ByWeekday = []GroupCount{}
+	}
+	if s.NextPerType == nil {
+		s.NextPerType = []Date{}
+	}
+	return s
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestUserTwoFactorNotFromClients(t *testing.T) {
+	body := `{"_id":"user@example.com","password":"secret","totpEnabled":true,"totpSecret":"ABC","recoveryCodes":["x"]}`
+	var u User
+	if err := json.Unmarshal([]byte(body), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.TOTPEnabled || u.TOTPSecret != "" || u.RecoveryCodes != nil {
+		t.Errorf("two-factor state read from the client: %+v", u)
+	}
+
+	u = User{Email: "user@example.com", TOTPEnabled: true, TOTPSecret: "ABC"}
+	out, err := json.Marshal(u.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "totp") {
+		t.Errorf("two-factor state sent to the client: %s", out)
+	}
+}
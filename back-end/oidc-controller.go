@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	db "remindal/internal/database"
+	"remindal/internal/oidc"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	TOKEN_OIDC      = "oidc"
+	TOKEN_OIDC_LINK = "oidc-link"
+)
+
+// Environment variable holding the client secret registered at the OpenID Connect
+// provider, kept out of the flags so that it does not show up in the process list
+const OIDC_CLIENT_SECRET_ENV = "REMINDAL_OIDC_CLIENT_SECRET"
+
+// Cookie binding a login to the browser it was started from, so that nobody can send
+// a user back with the code of another account
+const OIDC_COOKIE = "remindal_oidc"
+
+// How long users have to log in at the provider
+const OIDC_LOGIN_TTL = 10 * time.Minute
+
+var (
+	oidcIssuer      string
+	oidcClientID    string
+	oidcRedirectURL string
+	oidcReturnURL   string
+	oidcCreateUsers bool
+
+	// nil when single sign-on is not configured
+	oidcProvider *oidc.Provider
+)
+
+var (
+	errOIDCDisabled    = errors.New("single sign-on is not configured")
+	errOIDCUnavailable = errors.New("the identity provider cannot be reached")
+	errOIDCState       = errors.New("invalid or expired login, start again")
+	errOIDCRefused     = errors.New("the identity provider refused the login")
+	errOIDCEmail       = errors.New("the identity provider did not confirm the email of the account")
+	errOIDCLinked      = errors.New("the user is linked to another account of the identity provider")
+	errOIDCNoUser      = errors.New("no user is registered with the email of the account")
+	errOIDCMissingCode = errors.New("no code or state provided")
+	errOIDCLinkTOTP    = errors.New("the user has two-factor authentication, a code is required to link the account")
+	errOIDCLinkInvalid = errors.New("invalid, expired or already used link, log in again")
+)
+
+// Sets up the OpenID Connect provider, if one is configured
+func newOIDCProvider() error {
+	if oidcIssuer == "" {
+		return nil
+	}
+	if oidcClientID == "" {
+		return errors.New("single sign-on requires -oidc-client-id")
+	}
+	redirect := oidcRedirectURL
+	if redirect == "" {
+		redirect = strings.TrimRight(publicURL, "/") + "/user/oidc/callback"
+	}
+	oidcProvider = &oidc.Provider{
+		Issuer:       oidcIssuer,
+		ClientID:     oidcClientID,
+		ClientSecret: os.Getenv(OIDC_CLIENT_SECRET_ENV),
+		RedirectURL:  redirect,
+		Client:       &http.Client{Timeout: 10 * time.Second},
+	}
+	return nil
+}
+
+// Returns the cookie of the login with the state, expired if the state is empty
+func oidcCookie(state string) *http.Cookie {
+	c := &http.Cookie{
+		Name:     OIDC_COOKIE,
+		Value:    state,
+		Path:     "/user/oidc",
+		MaxAge:   int(OIDC_LOGIN_TTL / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(publicURL, "https://"),
+		// sent along when the provider redirects the browser back
+		SameSite: http.SameSiteLaxMode,
+	}
+	if state == "" {
+		c.MaxAge = -1
+	}
+	return c
+}
+
+// Returns the user linked to the account of the provider. Links the user registered
+// with the email of the account if there is one, or creates a new one. Users with
+// two-factor authentication are not linked, [errOIDCLinkTOTP] is returned instead and
+// the link waits for a code of the user.
+func oidcUser(ctx context.Context, claims oidc.Claims) (User, error) {
+	claims.Email = normalizeEmail(claims.Email)
+	var user User
+	err := db.GetOne(ctx, db.USER_COLLECTION, "oidcSubject", claims.Subject, &user)
+	if !errors.Is(err, db.ErrNotFound) {
+		return user, err
+	}
+
+	err = db.GetOne(ctx, db.USER_COLLECTION, EMAIL_KEY, claims.Email, &user)
+	if errors.Is(err, db.ErrNotFound) {
+		if !oidcCreateUsers {
+			return user, errOIDCNoUser
+		}
+		name := claims.GivenName
+		if name == "" {
+			name = claims.Name
+		}
+		user = User{
+			Email:       claims.Email,
+			Name:        name,
+			Surname:     claims.FamilyName,
+			Role:        ROLE_USER,
+			CreatedAt:   time.Now().UTC(),
+			OIDCSubject: claims.Subject,
+		}
+		return user, db.PutOne(ctx, db.USER_COLLECTION, user)
+	}
+	if err != nil {
+		return user, err
+	}
+	if user.OIDCSubject != "" {
+		return user, errOIDCLinked
+	}
+	// whoever controls the account of the provider must not get past the second factor
+	if user.TOTPEnabled {
+		return user, errOIDCLinkTOTP
+	}
+	return user, linkOIDCSubject(ctx, user.Email, claims.Subject)
+}
+
+// Links the user to the account of the provider with the subject, unless the user is
+// already linked. The provider confirmed the email, which is as good as the
+// verification link.
+func linkOIDCSubject(ctx context.Context, email, subject string) error {
+	query := bson.D{
+		{Key: EMAIL_KEY, Value: email},
+		{Key: "oidcSubject", Value: bson.D{{Key: "$exists", Value: false}}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "oidcSubject", Value: subject},
+		{Key: "unverified", Value: false},
+	}}}
+	err := db.UpdateOneMatching(ctx, db.USER_COLLECTION, query, update)
+	if errors.Is(err, db.ErrNotFound) {
+		// linked in the meantime
+		return errOIDCLinked
+	}
+	return err
+}
+
+// Stores the link of the account of the provider to the user, waiting for a code of
+// the user, and returns its token
+func pendOIDCLink(ctx context.Context, email, subject string) (OIDCPendingLink, error) {
+	token, err := newToken()
+	if err != nil {
+		return OIDCPendingLink{}, err
+	}
+	link := OIDCLink{
+		ID:        hashToken(token),
+		Kind:      TOKEN_OIDC_LINK,
+		User:      email,
+		Subject:   subject,
+		ExpiresAt: time.Now().UTC().Add(OIDC_LOGIN_TTL),
+	}
+	if err := db.PutOne(ctx, db.TOKEN_COLLECTION, link); err != nil {
+		return OIDCPendingLink{}, err
+	}
+	return OIDCPendingLink{LinkToken: token, ExpiresAt: link.ExpiresAt}, nil
+}
+
+// Handles requests to log in with the OpenID Connect provider.
+//
+// Starts a login with a new state, nonce and PKCE code verifier and redirects the
+// browser to the provider. The provider sends the user back to the callback. If an
+// error occurs, it responds with the appropriate error message and status code.
+func OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		Eres(w, Err404(errOIDCDisabled))
+		return
+	}
+
+	var values [3]string
+	for i := range values {
+		v, err := oidc.NewRandom()
+		if err != nil {
+			logger(r).Error("OIDCLoginHandler - oidc.NewRandom", "err", err)
+			Eres(w, Err500(err))
+			return
+		}
+		values[i] = v
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	login := OIDCLogin{
+		ID:        hashToken(state),
+		Kind:      TOKEN_OIDC,
+		Nonce:     nonce,
+		Verifier:  verifier,
+		ExpiresAt: time.Now().UTC().Add(OIDC_LOGIN_TTL),
+	}
+	if err := db.PutOne(r.Context(), db.TOKEN_COLLECTION, login); err != nil {
+		logger(r).Error("OIDCLoginHandler - db.PutOne", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	u, err := oidcProvider.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		logger(r).Error("OIDCLoginHandler - oidcProvider.AuthCodeURL", "err", err)
+		Eres(w, Err503(errOIDCUnavailable))
+		return
+	}
+	http.SetCookie(w, oidcCookie(state))
+	http.Redirect(w, r, u, http.StatusFound)
+}
+
+// Handles the requests of the users sent back by the OpenID Connect provider.
+//
+// Checks the state against the login started from the same browser, exchanges the
+// code for the ID token and logs in the user with the verified email of the account,
+// linking or creating the user if needed. Users with two-factor authentication are
+// given a link token instead of a session, to confirm the link with a code. Redirects to the return URL with the session
+// in the fragment if one is configured, otherwise writes the session as a JSON
+// response. If an error occurs, it responds with the appropriate error message and
+// status code.
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		Eres(w, Err404(errOIDCDisabled))
+		return
+	}
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		logger(r).Warn("login refused by the identity provider", "error", e, "description", query.Get("error_description"))
+		Eres(w, Err403(errOIDCRefused))
+		return
+	}
+	code, state := query.Get("code"), query.Get("state")
+	if code == "" || state == "" {
+		Eres(w, Err400(errOIDCMissingCode))
+		return
+	}
+	cookie, err := r.Cookie(OIDC_COOKIE)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		Eres(w, Err400(errOIDCState))
+		return
+	}
+	http.SetCookie(w, oidcCookie(""))
+
+	var login OIDCLogin
+	err = db.TakeOne(r.Context(), db.TOKEN_COLLECTION, bson.D{{Key: "_id", Value: hashToken(state)}, {Key: "kind", Value: TOKEN_OIDC}}, &login)
+	if errors.Is(err, db.ErrNotFound) {
+		Eres(w, Err400(errOIDCState))
+		return
+	}
+	if err != nil {
+		logger(r).Error("OIDCCallbackHandler - db.TakeOne", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	// expired logins are removed by the database in the background, not right away
+	if time.Now().After(login.ExpiresAt) {
+		Eres(w, Err400(errOIDCState))
+		return
+	}
+
+	claims, err := oidcProvider.Exchange(r.Context(), code, login.Verifier, login.Nonce)
+	if errors.Is(err, oidc.ErrInvalidToken) {
+		logger(r).Warn("OIDCCallbackHandler - oidcProvider.Exchange", "err", err)
+		Eres(w, Err401(errOIDCRefused))
+		return
+	}
+	if err != nil {
+		logger(r).Error("OIDCCallbackHandler - oidcProvider.Exchange", "err", err)
+		Eres(w, Err503(errOIDCUnavailable))
+		return
+	}
+	if claims.Email == "" || !claims.EmailVerified {
+		Eres(w, Err403(errOIDCEmail))
+		return
+	}
+
+	user, err := oidcUser(r.Context(), claims)
+	if errors.Is(err, errOIDCLinkTOTP) {
+		pending, err := pendOIDCLink(r.Context(), user.Email, claims.Subject)
+		if err != nil {
+			logger(r).Error("OIDCCallbackHandler - pendOIDCLink", "err", err)
+			Eres(w, ErrFrom(err))
+			return
+		}
+		if oidcReturnURL == "" {
+			Okres(w, pending)
+			return
+		}
+		fragment := url.Values{
+			"linkToken": {pending.LinkToken},
+			"expiresAt": {pending.ExpiresAt.Format(time.RFC3339)},
+		}
+		http.Redirect(w, r, oidcReturnURL+"#"+fragment.Encode(), http.StatusFound)
+		return
+	}
+	if errors.Is(err, errOIDCLinked) {
+		Eres(w, Err409(err))
+		return
+	}
+	if errors.Is(err, errOIDCNoUser) {
+		Eres(w, Err403(err))
+		return
+	}
+	if err != nil {
+		logger(r).Error("OIDCCallbackHandler - oidcUser", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+
+	if user.DeleteAt != nil {
+		err := restoreAccount(r.Context(), user.Email, AUDIT_SELF)
+		if errors.Is(err, errAccountPurging) {
+			Eres(w, Err403(err))
+			return
+		}
+		if err != nil && !errors.Is(err, errDeletionNotScheduled) {
+			logger(r).Error("OIDCCallbackHandler - restoreAccount", "err", err)
+			Eres(w, ErrFrom(err))
+			return
+		}
+	}
+
+	session, err := newSession(r.Context(), user.Email)
+	if err != nil {
+		logger(r).Error("OIDCCallbackHandler - newSession", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	if oidcReturnURL == "" {
+		Okres(w, session)
+		return
+	}
+	// the fragment is never sent to servers, only the client reads it
+	fragment := url.Values{
+		"token":     {session.Token},
+		"expiresAt": {session.ExpiresAt.Format(time.RFC3339)},
+	}
+	http.Redirect(w, r, oidcReturnURL+"#"+fragment.Encode(), http.StatusFound)
+}
+
+// Handles requests to confirm the link of an account of the OpenID Connect provider to
+// a user with two-factor authentication.
+//
+// Reads the link token given by the callback and a code of the user from the request
+// body. If the code is valid, links the account and writes a new session as a JSON
+// response. The link token cannot be used again and wrong codes count as failed
+// logins. If an error occurs, it responds with the appropriate error message and
+// status code.
+func ConfirmOIDCLinkHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger(r).Error("ConfirmOIDCLinkHandler - io.ReadAll", "err", err)
+		Eres(w, Err500(err))
+		return
+	}
+	var req OIDCLinkConfirmation
+	if err := json.Unmarshal(body, &req); err != nil {
+		Eres(w, Err400(err))
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		Eres(w, Err400(localize(err, r)))
+		return
+	}
+
+	var link OIDCLink
+	query := bson.D{{Key: "_id", Value: hashToken(req.LinkToken)}, {Key: "kind", Value: TOKEN_OIDC_LINK}}
+	err = db.TakeOne(r.Context(), db.TOKEN_COLLECTION, query, &link)
+	if errors.Is(err, db.ErrNotFound) {
+		Eres(w, Err400(errOIDCLinkInvalid))
+		return
+	}
+	if err != nil {
+		logger(r).Error("ConfirmOIDCLinkHandler - db.TakeOne", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	// expired links are removed by the database in the background, not right away
+	if time.Now().After(link.ExpiresAt) {
+		Eres(w, Err400(errOIDCLinkInvalid))
+		return
+	}
+	if !checkLockout(w, r, link.User) {
+		return
+	}
+
+	var user User
+	if err := db.GetOne(r.Context(), db.USER_COLLECTION, EMAIL_KEY, link.User, &user); err != nil {
+		logger(r).Error("ConfirmOIDCLinkHandler - db.GetOne", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	if user.TOTPEnabled {
+		ok, err := verifySecondFactor(r.Context(), user, req.Code)
+		if err != nil {
+			logger(r).Error("ConfirmOIDCLinkHandler - verifySecondFactor", "err", err)
+			Eres(w, ErrFrom(err))
+			return
+		}
+		if !ok {
+			recordLogin(r, link.User, false)
+			Eres(w, Err401(errInvalidCode))
+			return
+		}
+	}
+	recordLogin(r, link.User, true)
+
+	err = linkOIDCSubject(r.Context(), user.Email, link.Subject)
+	if errors.Is(err, errOIDCLinked) {
+		Eres(w, Err409(err))
+		return
+	}
+	if err != nil {
+		logger(r).Error("ConfirmOIDCLinkHandler - linkOIDCSubject", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	if user.DeleteAt != nil {
+		err := restoreAccount(r.Context(), user.Email, AUDIT_SELF)
+		if errors.Is(err, errAccountPurging) {
+			Eres(w, Err403(err))
+			return
+		}
+		if err != nil && !errors.Is(err, errDeletionNotScheduled) {
+			logger(r).Error("ConfirmOIDCLinkHandler - restoreAccount", "err", err)
+			Eres(w, ErrFrom(err))
+			return
+		}
+	}
+
+	session, err := newSession(r.Context(), user.Email)
+	if err != nil {
+		logger(r).Error("ConfirmOIDCLinkHandler - newSession", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	Okres(w, session)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	db "remindal/internal/database"
+	"remindal/internal/mail"
+	"remindal/internal/ratelimit"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const TOKEN_RESET = "reset"
+
+var (
+	resetTokenTTL     time.Duration
+	resetRequestLimit = ratelimit.Limit{Count: 3, Period: time.Hour}
+	// page of the client users choose a new password on, it POSTs the token of the
+	// link along with the password to the reset route
+	resetPasswordURL string
+)
+
+var errResetUnconfigured = errors.New("password reset is not available, no page to reset the password on is configured")
+
+// Replaces the password of the user with the hash of the new one and ends every
+// session of the user, so that whoever knew the old password is logged out
+func setPassword(r *http.Request, email, password string, set bson.D) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	set = append(set, bson.E{Key: "password", Value: hash})
+	if err := db.UpdateOne(r.Context(), db.USER_COLLECTION, EMAIL_KEY, email, set); err != nil {
+		return err
+	}
+	return revokeSessions(r.Context(), email)
+}
+
+// Handles requests to reset a forgotten password.
+//
+// Reads the email from the request body and, if it belongs to a user, sends a link to
+// reset the password, revoking the previous ones. Responds the same way whether the
+// email is registered or not. Each email can only be sent a few links per period. The
+// link opens the reset page of the client, unavailable if none is configured.
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if resetPasswordURL == "" {
+		Eres(w, Err503(errResetUnconfigured))
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger(r).Error("ForgotPasswordHandler - io.ReadAll", "err", err)
+		Eres(w, Err500(err))
+		return
+	}
+
+	var req EmailRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		Eres(w, Err400(err))
+		return
+	}
+	req.Email = normalizeEmail(req.Email)
+	if err := validate.Struct(req); err != nil {
+		Eres(w, Err400(localize(err, r)))
+		return
+	}
+
+	wait, err := limiter.Allow(r.Context(), "reset-request:"+req.Email, resetRequestLimit)
+	if err != nil {
+		logger(r).Error("ForgotPasswordHandler - limiter.Allow", "err", err)
+	}
+	if wait > 0 {
+		Eres(w, Err429(errRateLimited, wait))
+		return
+	}
+
+	var user User
+	err = db.GetOne(r.Context(), db.USER_COLLECTION, EMAIL_KEY, req.Email, &user)
+	if errors.Is(err, db.ErrNotFound) {
+		Okres(w, nil)
+		return
+	}
+	if err != nil {
+		logger(r).Error("ForgotPasswordHandler - db.GetOne", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+
+	token, err := issueEmailToken(r.Context(), TOKEN_RESET, user.Email, resetTokenTTL)
+	if err != nil {
+		logger(r).Error("ForgotPasswordHandler - issueEmailToken", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	sendEmail(r, mail.Message{
+		To:      user.Email,
+		Subject: "Reset your Remindal password",
+		Body: "Someone asked to reset the password of your Remindal account.\n\n" +
+			"Choose a new password by opening the link below:\n" +
+			pageLink(resetPasswordURL, url.Values{TOKEN_KEY: {token}}) + "\n\n" +
+			"The link expires in " + resetTokenTTL.String() + ". If it was not you, ignore this email, your password is unchanged.\n",
+	})
+	Okres(w, nil)
+}
+
+// Handles requests to set a new password with a token received by email.
+//
+// Reads the token and the new password from the request body, checks the password
+// against the policy and sets it, ending every session of the user. The token cannot
+// be used again. Since the token proves the ownership of the email, an unverified
+// user becomes verified. If an error occurs, it responds with the appropriate error
+// message and status code.
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger(r).Error("ResetPasswordHandler - io.ReadAll", "err", err)
+		Eres(w, Err500(err))
+		return
+	}
+
+	var req PasswordReset
+	if err := json.Unmarshal(body, &req); err != nil {
+		Eres(w, Err400(err))
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		Eres(w, Err400(localize(err, r)))
+		return
+	}
+
+	t, err := consumeEmailToken(r.Context(), TOKEN_RESET, req.Token)
+	if errors.Is(err, errInvalidEmailToken) {
+		Eres(w, Err400(err))
+		return
+	}
+	if err != nil {
+		logger(r).Error("ResetPasswordHandler - consumeEmailToken", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+
+	err = setPassword(r, t.User, req.Password, bson.D{{Key: "unverified", Value: false}})
+	if errors.Is(err, db.ErrNotFound) {
+		Eres(w, Err400(errInvalidEmailToken))
+		return
+	}
+	if err != nil {
+		logger(r).Error("ResetPasswordHandler - setPassword", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	recordLogin(r, t.User, true)
+	Okres(w, nil)
+}
+
+// Handles requests of a logged in user to change the password.
+//
+// Reads the current and the new password from the request body. If the current one
+// matches, sets the new one and ends every session of the user, then logs the user in
+// again and writes the new session as a JSON response. Wrong current passwords count
+// as failed logins. If an error occurs, it responds with the appropriate error
+// message and status code.
+func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger(r).Error("ChangePasswordHandler - io.ReadAll", "err", err)
+		Eres(w, Err500(err))
+		return
+	}
+
+	var req PasswordChange
+	if err := json.Unmarshal(body, &req); err != nil {
+		Eres(w, Err400(err))
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		Eres(w, Err400(localize(err, r)))
+		return
+	}
+
+	p := principalOf(r)
+	account := p.Email
+	if !checkLockout(w, r, account) {
+		return
+	}
+
+	var user User
+	if err := db.GetOne(r.Context(), db.USER_COLLECTION, EMAIL_KEY, p.Email, &user); err != nil {
+		logger(r).Error("ChangePasswordHandler - db.GetOne", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	ok, _ := checkPassword(user.Password, req.OldPassword)
+	recordLogin(r, account, ok)
+	if !ok {
+		Eres(w, Err403(errInvalidCredentials))
+		return
+	}
+
+	if err := setPassword(r, user.Email, req.NewPassword, bson.D{}); err != nil {
+		logger(r).Error("ChangePasswordHandler - setPassword", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	session, err := newSession(r.Context(), user.Email)
+	if err != nil {
+		logger(r).Error("ChangePasswordHandler - newSession", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	Okres(w, session)
+}
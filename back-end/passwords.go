@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errInvalidCredentials = errors.New("invalid email or password")
+
+// Compared against when the user does not exist, so that the response time does not
+// tell whether an email is registered
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("remindal-dummy-password"), bcrypt.DefaultCost)
+
+// Returns the bcrypt hash of the password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// Reports whether the stored password is a bcrypt hash. Users created before
+// passwords were hashed still have them in plain text.
+func isHashed(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// Reports whether the password matches the stored one, and whether the stored one
+// is in plain text and must be replaced by its hash
+func checkPassword(stored, password string) (ok bool, rehash bool) {
+	if !isHashed(stored) {
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return ok, ok
+	}
+	return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil, false
+}
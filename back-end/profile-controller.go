@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	db "remindal/internal/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Largest width and height of an avatar, bigger images are refused before being decoded
+const MAX_AVATAR_SIDE = 2048
+
+var (
+	avatarDir      string
+	maxAvatarBytes int64
+)
+
+var (
+	errAvatarTooLarge = errors.New("the avatar is too large")
+	errAvatarFormat   = errors.New("the avatar must be a PNG, JPEG or GIF image")
+	errNoAvatar       = errors.New("no avatar uploaded")
+)
+
+// Content types the avatars are served with, by image format
+var avatarTypes = map[string]string{
+	"png":  "image/png",
+	"jpeg": "image/jpeg",
+	"gif":  "image/gif",
+}
+
+// Handles requests to retrieve the profile of the logged in user.
+//
+// Fetches the user from the database and writes it as a JSON response. If an error
+// occurs, it responds with the appropriate error message and status code.
+func GetMeHandler(w http.ResponseWriter, r *http.Request) {
+	var user User
+	if err := db.GetOne(r.Context(), db.USER_COLLECTION, EMAIL_KEY, principalOf(r).Email, &user); err != nil {
+		logger(r).Error("GetMeHandler - db.GetOne", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	Okres(w, user.Public())
+}
+
+// Handles requests to update the profile of the logged in user.
+//
+// Reads the changes from the request body, validates them and applies them, leaving
+// the fields that are not given unchanged. Writes the updated user as a JSON response.
+// If an error occurs, it responds with the appropriate error message and status code.
+func PutMeHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger(r).Error("PutMeHandler - io.ReadAll", "err", err)
+		Eres(w, Err500(err))
+		return
+	}
+
+	var req ProfileUpdate
+	if err := json.Unmarshal(body, &req); err != nil {
+		Eres(w, Err400(err))
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		Eres(w, Err400(localize(err, r)))
+		return
+	}
+
+	set := bson.D{}
+	if req.Name != "" {
+		set = append(set, bson.E{Key: "name", Value: req.Name})
+	}
+	if req.Surname != "" {
+		set = append(set, bson.E{Key: "surname", Value: req.Surname})
+	}
+	if req.BirthDate != "" {
+		birth, _ := time.Parse(DATE_LAYOUT, req.BirthDate)
+		set = append(set,
+			bson.E{Key: "birthDate", Value: req.BirthDate},
+			bson.E{Key: "age", Value: ageOn(birth, time.Now())},
+		)
+	}
+	if req.Preferences != nil {
+		set = append(set, bson.E{Key: "preferences", Value: req.Preferences})
+	}
+
+	email := principalOf(r).Email
+	if len(set) > 0 {
+		if err := db.UpdateOne(r.Context(), db.USER_COLLECTION, EMAIL_KEY, email, set); err != nil {
+			logger(r).Error("PutMeHandler - db.UpdateOne", "err", err)
+			Eres(w, ErrFrom(err))
+			return
+		}
+	}
+	var user User
+	if err := db.GetOne(r.Context(), db.USER_COLLECTION, EMAIL_KEY, email, &user); err != nil {
+		logger(r).Error("PutMeHandler - db.GetOne", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	Okres(w, user.Public())
+}
+
+// Returns the path of the avatar file
+func avatarPath(name string) string {
+	return filepath.Join(avatarDir, filepath.Base(name))
+}
+
+// Removes the avatar file, failures are only logged since the file is not referenced anymore
+func removeAvatar(name string) {
+	if name == "" {
+		return
+	}
+	if err := os.Remove(avatarPath(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("removeAvatar - os.Remove", "err", err, "file", name)
+	}
+}
+
+// Handles requests to upload the avatar of the logged in user.
+//
+// Reads the image from the request body, checks its size, format and dimensions and
+// stores it in the avatar directory, replacing the previous one. If an error occurs, it
+// responds with the appropriate error message and status code.
+func PutAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAvatarBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		Eres(w, Err400(errAvatarTooLarge))
+		return
+	}
+	if err != nil {
+		logger(r).Error("PutAvatarHandler - io.ReadAll", "err", err)
+		Eres(w, Err500(err))
+		return
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil || avatarTypes[format] == "" {
+		Eres(w, Err400(errAvatarFormat))
+		return
+	}
+	if cfg.Width > MAX_AVATAR_SIDE || cfg.Height > MAX_AVATAR_SIDE {
+		Eres(w, Err400(errAvatarTooLarge))
+		return
+	}
+	// decoding the whole image rejects the truncated and corrupted ones
+	if _, _, err := image.Decode(bytes.NewReader(body)); err != nil {
+		Eres(w, Err400(errAvatarFormat))
+		return
+	}
+
+	token, err := newToken()
+	if err != nil {
+		logger(r).Error("PutAvatarHandler - newToken", "err", err)
+		Eres(w, Err500(err))
+		return
+	}
+	name := token + "." + format
+	if err := os.WriteFile(avatarPath(name), body, 0o644); err != nil {
+		logger(r).Error("PutAvatarHandler - os.WriteFile", "err", err)
+		Eres(w, Err500(err))
+		return
+	}
+
+	var user User
+	query := bson.D{{Key: EMAIL_KEY, Value: principalOf(r).Email}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "avatar", Value: name}}}}
+	if err := db.FindOneAndUpdate(r.Context(), db.USER_COLLECTION, query, update, &user); err != nil {
+		removeAvatar(name)
+		logger(r).Error("PutAvatarHandler - db.FindOneAndUpdate", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	removeAvatar(user.Avatar)
+	Okres(w, nil)
+}
+
+// Handles requests to retrieve the avatar of the logged in user.
+//
+// Writes the image with its content type. If an error occurs, it responds with the
+// appropriate error message and status code.
+func GetAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	var user User
+	if err := db.GetOne(r.Context(), db.USER_COLLECTION, EMAIL_KEY, principalOf(r).Email, &user); err != nil {
+		logger(r).Error("GetAvatarHandler - db.GetOne", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	if user.Avatar == "" {
+		Eres(w, Err404(errNoAvatar))
+		return
+	}
+	f, err := os.Open(avatarPath(user.Avatar))
+	if errors.Is(err, os.ErrNotExist) {
+		Eres(w, Err404(errNoAvatar))
+		return
+	}
+	if err != nil {
+		logger(r).Error("GetAvatarHandler - os.Open", "err", err)
+		Eres(w, Err500(err))
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		logger(r).Error("GetAvatarHandler - f.Stat", "err", err)
+		Eres(w, Err500(err))
+		return
+	}
+
+	format := filepath.Ext(user.Avatar)
+	if format != "" {
+		format = format[1:]
+	}
+	w.Header().Set("Content-Type", avatarTypes[format])
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	http.ServeContent(w, r, user.Avatar, info.ModTime(), f)
+}
+
+// Handles requests to remove the avatar of the logged in user.
+//
+// If an error occurs, it responds with the appropriate error message and status code.
+func DelAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	var user User
+	query := bson.D{{Key: EMAIL_KEY, Value: principalOf(r).Email}}
+	update := bson.D{{Key: "$unset", Value: bson.D{{Key: "avatar", Value: ""}}}}
+	if err := db.FindOneAndUpdate(r.Context(), db.USER_COLLECTION, query, update, &user); err != nil {
+		logger(r).Error("DelAvatarHandler - db.FindOneAndUpdate", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	removeAvatar(user.Avatar)
+	Okres(w, nil)
+}
+
+// Creates the avatar directory if it does not exist
+func ensureAvatarDir() error {
+	if err := os.MkdirAll(avatarDir, 0o755); err != nil {
+		return fmt.Errorf("creating the avatar directory: %w", err)
+	}
+	return nil
+}
+
+// Updates the stored age of the users having their birthday, every interval until the
+// context is done, so that the age filters of the user list stay accurate
+func refreshAges(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now().UTC()
+			days := []string{now.Format("-01-02")}
+			// people born on February 29 get older on March 1 in common years
+			if now.Month() == time.March && now.Day() == 1 && now.AddDate(0, 0, -1).Day() == 28 {
+				days = append(days, "-02-29")
+			}
+			for _, day := range days {
+				var users []User
+				query := bson.D{{Key: "birthDate", Value: bson.D{{Key: "$regex", Value: day + "$"}}}}
+				if err := db.GetMany(ctx, db.USER_COLLECTION, query, db.CreateSort(EMAIL_KEY, 1), &users); err != nil {
+					slog.Error("refreshAges - db.GetMany", "err", err)
+					continue
+				}
+				for _, u := range users {
+					age := u.Public().Age
+					if age == u.Age {
+						continue
+					}
+					if err := db.UpdateOne(ctx, db.USER_COLLECTION, EMAIL_KEY, u.Email, bson.D{{Key: "age", Value: age}}); err != nil {
+						slog.Error("refreshAges - db.UpdateOne", "err", err, "user", u.Email)
+					}
+				}
+			}
+		}
+	}
+}
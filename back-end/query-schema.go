@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	db "remindal/internal/database"
+	"sort"
+	"strconv"
+)
+
+// Kind of value held by a query parameter
+type paramType int
+
+const (
+	stringParam paramType = iota
+	intParam
+)
+
+// Operators a filter allows, they can be combined
+type filterOp int
+
+const (
+	opEq    filterOp = 1 << iota // single value, e.g. year=2024
+	opRange                      // inclusive bounds, e.g. minyear=2020&maxyear=2024
+	opMulti                      // values separated by MULTI_SEL_SEPARATOR, e.g. labels=work,home
+	opText                       // full-text search
+)
+
+// Declares how a document field can be filtered through the HTTP URL query
+type filterSpec struct {
+	field    string // document field, also the name of the parameter for every operator but opRange
+	minParam string // name of the lower bound parameter when opRange is allowed
+	maxParam string // name of the upper bound parameter when opRange is allowed
+	typ      paramType
+	ops      filterOp
+	lo, hi   int // inclusive bounds of intParam values
+}
+
+// Whitelist of the filters a resource can be queried by
+type filterSchema []filterSpec
+
+var dateFilters = filterSchema{
+	{field: SEARCH, typ: stringParam, ops: opText},
+	{field: LABELS, typ: stringParam, ops: opMulti},
+	{field: DATE_TYPE, typ: stringParam, ops: opEq},
+	{field: YEAR, minParam: MIN_YEAR, maxParam: MAX_YEAR, typ: intParam, ops: opEq | opRange, lo: math.MinInt16, hi: math.MaxInt16},
+	{field: MONTH, minParam: MIN_MONTH, maxParam: MAX_MONTH, typ: intParam, ops: opEq | opRange, lo: 1, hi: 12},
+	{field: DAY, minParam: MIN_DAY, maxParam: MAX_DAY, typ: intParam, ops: opEq | opRange, lo: 1, hi: 31},
+	{field: HOURS, minParam: MIN_HOURS, maxParam: MAX_HOURS, typ: intParam, ops: opEq | opRange, lo: 0, hi: 23},
+	{field: MINUTES, minParam: MIN_MINUTES, maxParam: MAX_MINUTES, typ: intParam, ops: opEq | opRange, lo: 0, hi: 59},
+}
+
+// Agenda and calendar views are already filtered by time, so only the descriptive filters apply
+var agendaFilters = filterSchema{
+	{field: LABELS, typ: stringParam, ops: opMulti},
+	{field: DATE_TYPE, typ: stringParam, ops: opEq},
+}
+
+var userFilters = filterSchema{
+	{field: EMAIL, typ: stringParam, ops: opEq},
+	{field: NAME, typ: stringParam, ops: opMulti},
+	{field: SURNAME, typ: stringParam, ops: opMulti},
+	{field: AGE, minParam: MIN_AGE, maxParam: MAX_AGE, typ: intParam, ops: opEq | opRange, lo: 0, hi: math.MaxUint8},
+}
+
+// A problem with a single query parameter
+type ParamError struct {
+	Param  string `json:"param"`
+	Reason string `json:"reason"`
+}
+
+func (pe *ParamError) Error() string {
+	return fmt.Sprintf("%s: %s", pe.Param, pe.Reason)
+}
+
+// Validates the HTTP URL query against the schema and adds the filters to the query.
+// Every problem found is added to the QueryBuilder as a [ParamError], so that all of
+// them can be reported at once.
+func (s filterSchema) build(q url.Values, b *db.QueryBuilder) {
+	s.checkParams(q, b)
+	for _, f := range s {
+		f.apply(q, b)
+	}
+}
+
+// Reports the parameters that are not part of the schema and the ones given more than once
+func (s filterSchema) checkParams(q url.Values, b *db.QueryBuilder) {
+	known := map[string]bool{}
+	for _, f := range s {
+		known[f.field] = f.ops&(opEq|opMulti|opText) != 0
+		if f.ops&opRange != 0 {
+			known[f.minParam] = true
+			known[f.maxParam] = true
+		}
+	}
+
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if !known[k] {
+			b.AddErr(&ParamError{Param: k, Reason: "unknown parameter"})
+			continue
+		}
+		if len(q[k]) > 1 {
+			b.AddErr(&ParamError{Param: k, Reason: "given more than once"})
+		}
+	}
+}
+
+// Adds the filters declared by the spec for the parameters that have a value
+func (f filterSpec) apply(q url.Values, b *db.QueryBuilder) {
+	v := q.Get(f.field)
+	switch {
+	case f.ops&opText != 0:
+		addSearchFilter(v, b)
+	case f.ops&opMulti != 0:
+		addMultiSelectFilter(f.field, v, MULTI_SEL_SEPARATOR, b)
+	}
+
+	min, max := "", ""
+	if f.ops&opRange != 0 {
+		min, max = q.Get(f.minParam), q.Get(f.maxParam)
+		if hasValue(min) {
+			b.AddRangeField(f.field, min, true, f.conv(f.minParam))
+		}
+		if hasValue(max) {
+			b.AddRangeField(f.field, max, false, f.conv(f.maxParam))
+		}
+	}
+
+	if f.ops&opEq == 0 || !hasValue(v) {
+		return
+	}
+	if hasValue(min) || hasValue(max) {
+		reason := fmt.Sprintf("cannot be combined with %s or %s", f.minParam, f.maxParam)
+		b.AddErr(&ParamError{Param: f.field, Reason: reason})
+		return
+	}
+	if f.typ == stringParam {
+		addSimpleFilter(f.field, v, b)
+		return
+	}
+	b.AddFieldCnv(f.field, v, f.conv(f.field))
+}
+
+// Returns the conversion function for the values of param. Malformed and out of
+// bounds values are reported as a [ParamError].
+func (f filterSpec) conv(param string) convFunc {
+	return func(s string) (any, error) {
+		if f.typ != intParam {
+			return s, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, &ParamError{Param: param, Reason: "must be an integer"}
+		}
+		if n < f.lo || n > f.hi {
+			reason := fmt.Sprintf("must be between %d and %d", f.lo, f.hi)
+			return nil, &ParamError{Param: param, Reason: reason}
+		}
+		return n, nil
+	}
+}
+
+// Collects every [ParamError] wrapped inside err, including the ones joined together.
+func paramErrors(err error) []*ParamError {
+	var pe *ParamError
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var errs []*ParamError
+		for _, e := range joined.Unwrap() {
+			errs = append(errs, paramErrors(e)...)
+		}
+		return errs
+	}
+	if errors.As(err, &pe) {
+		return []*ParamError{pe}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	db "remindal/internal/database"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestFilterSchemaBuild(t *testing.T) {
+	q, _ := url.ParseQuery("name=ann,bob&surname=lee&minage=18&maxage=30&_id=ann@example.com")
+	b := db.NewQueryBuilder()
+	userFilters.build(q, &b)
+	if err := b.Err(); err != nil {
+		t.Fatal(err)
+	}
+	// every key appears once: the multi selects share an $and, the bounds share the field
+	want := bson.D{
+		{Key: EMAIL, Value: "ann@example.com"},
+		{Key: "$and", Value: bson.A{
+			bson.D{{Key: "$or", Value: bson.A{bson.D{{Key: NAME, Value: "ann"}}, bson.D{{Key: NAME, Value: "bob"}}}}},
+			bson.D{{Key: "$or", Value: bson.A{bson.D{{Key: SURNAME, Value: "lee"}}}}},
+		}},
+		{Key: AGE, Value: bson.D{{Key: "$gte", Value: 18}, {Key: "$lte", Value: 30}}},
+	}
+	if got := b.Query(); !reflect.DeepEqual(got, want) {
+		t.Errorf("query = %v, want %v", got, want)
+	}
+}
+
+func TestFilterSchemaErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []ParamError
+	}{
+		{"color=red", []ParamError{{Param: "color", Reason: "unknown parameter"}}},
+		{"year=2024&year=2025", []ParamError{{Param: YEAR, Reason: "given more than once"}}},
+		// the bounds of a range are only known by their own names
+		{"minyear=x", []ParamError{{Param: MIN_YEAR, Reason: "must be an integer"}}},
+		{"month=13", []ParamError{{Param: MONTH, Reason: "must be between 1 and 12"}}},
+		{"year=2024&minyear=2020", []ParamError{{Param: YEAR, Reason: "cannot be combined with minyear or maxyear"}}},
+		{"labels=a&minmonth=0&maxmonth=x", []ParamError{
+			{Param: MIN_MONTH, Reason: "must be between 1 and 12"},
+			{Param: MAX_MONTH, Reason: "must be an integer"},
+		}},
+	}
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		b := db.NewQueryBuilder()
+		dateFilters.build(q, &b)
+		var got []ParamError
+		for _, pe := range paramErrors(b.Err()) {
+			got = append(got, *pe)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("build(%q) errors = %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"remindal/internal/metrics"
+	"remindal/internal/ratelimit"
+	"strings"
+	"time"
+)
+
+// Stores the rate limiting counters can be kept in
+const (
+	RATE_STORE_MEMORY   = "memory"
+	RATE_STORE_DATABASE = "database"
+)
+
+var (
+	rateLimit        = ratelimit.Limit{Count: 300, Period: time.Minute}
+	authRateLimit    = ratelimit.Limit{Count: 20, Period: time.Minute}
+	accountRateLimit = ratelimit.Limit{Count: 10, Period: time.Minute}
+	rateStore        string
+	trustedProxies   int
+
+	limiter = &ratelimit.Limiter{
+		Lockout: ratelimit.Lockout{Threshold: 5, Base: time.Minute, Max: time.Hour},
+	}
+)
+
+// Routes dealing with credentials or looking accounts up, limited more strictly
+// than the others both by client and by account
+var authRoutes = map[string]bool{
+	"/user/":      true,
+	"/user/list":  true,
+	"/user/post":  true,
+	"/user/login": true,
+
+	"/user/verify":        true,
+	"/user/verify/resend": true,
+
+	"/user/password/forgot": true,
+	"/user/password/reset":  true,
+	"/user/password/change": true,
+
+	"/user/export/download": true,
+
+	"/user/oidc/login":    true,
+	"/user/oidc/callback": true,
+	"/user/oidc/link":     true,
+
+	"/user/2fa/confirm": true,
+	"/user/2fa/disable": true,
+	"/user/del":         true,
+}
+
+// Routes polled by the infrastructure, never limited
+var unlimitedRoutes = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+var (
+	errRateLimited   = errors.New("too many requests, retry later")
+	errAccountLocked = errors.New("too many failed logins, the account is temporarily locked")
+)
+
+// Bucket a request takes a token from, the scope labels the rejections in the metrics
+type rateBucket struct {
+	scope string
+	key   string
+	limit ratelimit.Limit
+}
+
+// Sets up the store of the limiter. The memory store is swept periodically by a worker.
+func newRateLimiter() error {
+	switch rateStore {
+	case RATE_STORE_MEMORY:
+		store := ratelimit.NewMemoryStore()
+		limiter.Store = store
+		requiredWorkers = append(requiredWorkers, "rate-limit-sweep")
+		workers.Go("rate-limit-sweep", func(ctx context.Context) {
+			store.SweepEvery(ctx, time.Minute)
+		})
+	case RATE_STORE_DATABASE:
+		limiter.Store = ratelimit.DatabaseStore{}
+	default:
+		return fmt.Errorf("unknown rate limit store %q, must be %s or %s", rateStore, RATE_STORE_MEMORY, RATE_STORE_DATABASE)
+	}
+	return nil
+}
+
+// Returns the IP address of the client. Behind trusted proxies, each of which appends
+// the address it got the request from to the X-Forwarded-For header, the address is
+// the one the outermost proxy appended, counting back from the right. The addresses
+// to its left are set by the client and never trusted.
+func clientIP(r *http.Request) string {
+	if trustedProxies > 0 {
+		var hops []string
+		for _, h := range r.Header.Values("X-Forwarded-For") {
+			for _, a := range strings.Split(h, ",") {
+				if a = strings.TrimSpace(a); a != "" {
+					hops = append(hops, a)
+				}
+			}
+		}
+		if len(hops) > 0 {
+			// fewer hops than proxies only leaves addresses appended by the proxies
+			return hops[max(len(hops)-trustedProxies, 0)]
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Largest part of a body read to find the account a request is about, credentials
+// are far smaller
+const MAX_ACCOUNT_BODY = 64 << 10
+
+// Returns the account the request is about, named by the email of the credentials in
+// the JSON body or by the query, empty if it names none. The body is left whole for
+// the handler to read.
+func accountOf(r *http.Request) string {
+	if r.Body != nil && r.Body != http.NoBody {
+		body, err := io.ReadAll(io.LimitReader(r.Body, MAX_ACCOUNT_BODY))
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		var creds struct {
+			Email string `json:"_id"`
+		}
+		if err == nil && json.Unmarshal(body, &creds) == nil && creds.Email != "" {
+			return normalizeEmail(creds.Email)
+		}
+	}
+	return normalizeEmail(r.URL.Query().Get(EMAIL_KEY))
+}
+
+// Middleware rejecting with 429 the requests of a client exceeding the rate limit.
+// Requests to the authentication routes are also limited by client and by account
+// under stricter limits. Probes are never limited, and requests
+// are let through if the store cannot be reached.
+func limitRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			ip    = clientIP(r)
+			route = routeTemplate(r)
+		)
+		if unlimitedRoutes[route] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		buckets := []rateBucket{{"ip", "ip:" + ip, rateLimit}}
+		if authRoutes[route] {
+			buckets = append(buckets, rateBucket{"auth_ip", "auth-ip:" + ip, authRateLimit})
+			if account := accountOf(r); account != "" {
+				buckets = append(buckets, rateBucket{"account", "account:" + account, accountRateLimit})
+			}
+		}
+
+		for _, b := range buckets {
+			wait, err := limiter.Allow(r.Context(), b.key, b.limit)
+			if err != nil {
+				logger(r).Error("limitRequests - limiter.Allow", "err", err)
+				continue
+			}
+			if wait > 0 {
+				if route == "" {
+					route = "unmatched"
+				}
+				metrics.HttpRateLimited.WithLabelValues(route, b.scope).Inc()
+				Eres(w, Err429(errRateLimited, wait))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Responds with 429 if the account is locked after too many failed logins. Returns
+// whether the login attempt can go on.
+func checkLockout(w http.ResponseWriter, r *http.Request, account string) bool {
+	wait, err := limiter.Locked(r.Context(), account)
+	if err != nil {
+		logger(r).Error("checkLockout - limiter.Locked", "err", err)
+		return true
+	}
+	if wait > 0 {
+		Eres(w, Err429(errAccountLocked, wait))
+		return false
+	}
+	return true
+}
+
+// Records the outcome of a login attempt, locking the account after too many failures
+func recordLogin(r *http.Request, account string, ok bool) {
+	if ok {
+		if err := limiter.LoginSucceeded(r.Context(), account); err != nil {
+			logger(r).Error("recordLogin - limiter.LoginSucceeded", "err", err)
+		}
+		return
+	}
+	locked, err := limiter.LoginFailed(r.Context(), account)
+	if err != nil {
+		logger(r).Error("recordLogin - limiter.LoginFailed", "err", err)
+		return
+	}
+	if locked > 0 {
+		logger(r).Warn("account locked", "account", account, "for", locked.String())
+	}
+}
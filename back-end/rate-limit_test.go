@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"remindal/internal/ratelimit"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestClientIP(t *testing.T) {
+	defer func(n int) { trustedProxies = n }(trustedProxies)
+	tests := []struct {
+		proxies int
+		fwd     []string
+		want    string
+	}{
+		{0, []string{"198.51.100.1"}, "192.0.2.1"},
+		// the client can put anything on the left, only the proxy hops are trusted
+		{1, []string{"198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+		{2, []string{"198.51.100.1, 203.0.113.7", "10.0.0.2"}, "203.0.113.7"},
+		{2, []string{"203.0.113.7"}, "203.0.113.7"},
+		{1, nil, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		trustedProxies = tt.proxies
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		for _, f := range tt.fwd {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("clientIP with %d proxies and %q = %s, want %s", tt.proxies, tt.fwd, got, tt.want)
+		}
+	}
+}
+
+func TestLimitRequestsByBodyAccount(t *testing.T) {
+	defer func(store ratelimit.Store, ip, auth, account ratelimit.Limit) {
+		limiter.Store, rateLimit, authRateLimit, accountRateLimit = store, ip, auth, account
+	}(limiter.Store, rateLimit, authRateLimit, accountRateLimit)
+	limiter.Store = ratelimit.NewMemoryStore()
+	rateLimit = ratelimit.Limit{}
+	authRateLimit = ratelimit.Limit{}
+	accountRateLimit = ratelimit.Limit{Count: 1, Period: time.Minute}
+
+	router := mux.NewRouter()
+	router.Use(limitRequests)
+	router.HandleFunc("/user/login", func(w http.ResponseWriter, r *http.Request) {
+		var creds Credentials
+		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil || creds.Password != "secret" {
+			t.Errorf("handler read %+v, %v, want the whole body", creds, err)
+		}
+	}).Methods("POST")
+
+	login := func(email, addr string) int {
+		body := `{"_id":"` + email + `","password":"secret"}`
+		r := httptest.NewRequest("POST", "/user/login", strings.NewReader(body))
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := login("user@example.com", "192.0.2.1:1"); code != http.StatusOK {
+		t.Fatalf("first login = %d", code)
+	}
+	// the account is limited whatever the client and the case of the email
+	if code := login("User@Example.com", "192.0.2.2:1"); code != http.StatusTooManyRequests {
+		t.Errorf("second login of the account = %d, want 429", code)
+	}
+	if code := login("other@example.com", "192.0.2.1:1"); code != http.StatusOK {
+		t.Errorf("login of another account = %d", code)
+	}
+}
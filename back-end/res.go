@@ -2,32 +2,54 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"math"
 	"net/http"
+	"strconv"
 )
 
 type ResponseAPI struct {
 	Ok      bool   `json:"ok"`
+	Code    string `json:"code,omitempty"`
 	Message string `json:"message,omitempty"`
 	Res     any    `json:"res,omitempty"`
+
+	Errors []*ParamError `json:"errors,omitempty"`
+	Fields []FieldError  `json:"fields,omitempty"`
 }
 
 // Sends an error response to the client with a description
 // and automatically detects the appropriate HTTP error status,
-// writing it to the header.
+// writing it to the header along with a stable error code. Problems with single
+// query parameters and fields that failed validation are listed one by one.
+// Errors telling the client to wait before retrying set the Retry-After header.
+// Nothing is written for requests the client gave up on.
 func Eres(w http.ResponseWriter, se *HttpError) {
-	res := ResponseAPI{Ok: false, Message: se.Error()}
+	if se.status == STATUS_CLIENT_CLOSED_REQUEST {
+		recordStatus(w, se.status)
+		return
+	}
+	res := ResponseAPI{
+		Ok:      false,
+		Code:    se.code,
+		Message: se.Error(),
+		Errors:  paramErrors(se.err),
+		Fields:  fieldErrors(se.err),
+	}
 
 	json, err := json.Marshal(res)
 	if err != nil {
-		log.Println("res.Err - json.Marshal ", err)
+		writerLogger(w).Error("res.Err - json.Marshal", "err", err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	if se.retryAfter > 0 {
+		// rounded up, so that clients never retry too early
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(se.retryAfter.Seconds()))))
+	}
 	w.WriteHeader(se.status)
 	if _, err = w.Write(json); err != nil {
-		log.Println("res.Err - w.Write ", err)
+		writerLogger(w).Error("res.Err - w.Write", "err", err)
 	}
 }
 
@@ -38,12 +60,12 @@ func Okres(w http.ResponseWriter, item any) {
 
 	json, err := json.Marshal(res)
 	if err != nil {
-		log.Println("res.Ok - json.Marshal ", err)
+		writerLogger(w).Error("res.Ok - json.Marshal", "err", err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if _, err = w.Write(json); err != nil {
-		log.Println("res.Ok - w.Write ", err)
+		writerLogger(w).Error("res.Ok - w.Write", "err", err)
 	}
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	db "remindal/internal/database"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Key of the single document holding the settings
+const SETTINGS_ID = "global"
+
+var errPasswordLoginDisabled = errors.New("password login is disabled, log in with single sign-on")
+
+// Returns the settings of the application, the defaults if they were never changed
+func getSettings(ctx context.Context) (Settings, error) {
+	var s Settings
+	err := db.GetOne(ctx, db.SETTINGS_COLLECTION, "_id", SETTINGS_ID, &s)
+	if errors.Is(err, db.ErrNotFound) {
+		return Settings{}, nil
+	}
+	return s, err
+}
+
+// Reports whether the user can log in with a password. Admins always can, so that
+// they are not locked out if the OpenID Connect provider is down or misconfigured.
+func passwordLoginAllowed(ctx context.Context, role string) (bool, error) {
+	if role == ROLE_ADMIN {
+		return true, nil
+	}
+	s, err := getSettings(ctx)
+	if err != nil {
+		return false, err
+	}
+	return !s.PasswordLoginDisabled, nil
+}
+
+// Handles requests of admins to retrieve the settings of the application.
+//
+// Writes the settings as a JSON response. If an error occurs, it responds with the
+// appropriate error message and status code.
+func GetSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := getSettings(r.Context())
+	if err != nil {
+		logger(r).Error("GetSettingsHandler - getSettings", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	Okres(w, s)
+}
+
+// Handles requests of admins to change the settings of the application.
+//
+// Reads the settings from the request body and stores them. If an error occurs, it
+// responds with the appropriate error message and status code.
+func PutSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger(r).Error("PutSettingsHandler - io.ReadAll", "err", err)
+		Eres(w, Err500(err))
+		return
+	}
+
+	var s Settings
+	if err := json.Unmarshal(body, &s); err != nil {
+		Eres(w, Err400(err))
+		return
+	}
+	if err := validate.Struct(s); err != nil {
+		Eres(w, Err400(localize(err, r)))
+		return
+	}
+
+	set := bson.D{{Key: "passwordLoginDisabled", Value: s.PasswordLoginDisabled}}
+	if err := db.UpsertOne(r.Context(), db.SETTINGS_COLLECTION, "_id", SETTINGS_ID, set); err != nil {
+		logger(r).Error("PutSettingsHandler - db.UpsertOne", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	logger(r).Info("settings changed", "by", principalOf(r).Email, "password_login_disabled", s.PasswordLoginDisabled)
+	Okres(w, s)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	tlsCert           string
+	tlsKey            string
+	tlsReloadInterval time.Duration
+	redirectPort      string
+	hstsMaxAge        time.Duration
+	hstsSubdomains    bool
+)
+
+// Serves the certificate and key pair from disk, loading it again whenever
+// one of the files is modified
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// Loads the certificate and key pair, failing if they cannot be used
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Returns the latest modification time among the certificate and key files
+func (cr *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Loads the pair again if the files changed since the last load. The previous pair
+// keeps being served if the new one cannot be loaded, e.g. while it is being written.
+func (cr *certReloader) reload() error {
+	modTime, err := cr.lastModified()
+	if err != nil {
+		return err
+	}
+	cr.mu.RLock()
+	unchanged := cr.cert != nil && modTime.Equal(cr.modTime)
+	cr.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.mu.Unlock()
+	slog.Info("loaded TLS certificate", "file", cr.certFile)
+	return nil
+}
+
+// Checks the files for changes at every interval until the context is done
+func (cr *certReloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := cr.reload(); err != nil {
+				slog.Error("certReloader.watch - cr.reload", "err", err)
+			}
+		}
+	}
+}
+
+// Used as [tls.Config.GetCertificate], returns the pair loaded last
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// Returns the TLS configuration serving the reloaded certificate. HTTP/2 is
+// negotiated by the server on top of it.
+func newTLSConfig(cr *certReloader) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.GetCertificate,
+	}
+}
+
+// Tells browsers to only reach the server, and its subdomains if configured, over
+// HTTPS from now on
+func hsts(next http.Handler) http.Handler {
+	value := fmt.Sprintf("max-age=%d", int(hstsMaxAge.Seconds()))
+	if hstsSubdomains {
+		value += "; includeSubDomains"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Redirects every request to the same URL over HTTPS on the TLS port, keeping the
+// method and the body
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if _, p, err := net.SplitHostPort(port); err == nil && p != "443" {
+		host = net.JoinHostPort(host, p)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
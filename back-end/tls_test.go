@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRedirectToHTTPS(t *testing.T) {
+	previous := port
+	t.Cleanup(func() { port = previous })
+
+	for listen, want := range map[string]string{
+		":443":  "https://remindal.example/date/post?x=1",
+		":8443": "https://remindal.example:8443/date/post?x=1",
+	} {
+		port = listen
+		r := httptest.NewRequest("POST", "http://remindal.example:8080/date/post?x=1", nil)
+		w := httptest.NewRecorder()
+		redirectToHTTPS(w, r)
+		// unlike 301, 308 keeps the method and the body
+		if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != want {
+			t.Errorf("port %s: %d to %q, want 308 to %q", listen, w.Code, w.Header().Get("Location"), want)
+		}
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	previousAge, previousSubdomains := hstsMaxAge, hstsSubdomains
+	t.Cleanup(func() { hstsMaxAge, hstsSubdomains = previousAge, previousSubdomains })
+	hstsMaxAge = time.Hour
+
+	for subdomains, want := range map[bool]string{
+		false: "max-age=3600",
+		true:  "max-age=3600; includeSubDomains",
+	} {
+		hstsSubdomains = subdomains
+		w := httptest.NewRecorder()
+		hsts(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if got := w.Header().Get("Strict-Transport-Security"); got != want {
+			t.Errorf("subdomains %v: header %q, want %q", subdomains, got, want)
+		}
+	}
+}
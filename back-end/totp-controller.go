@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	db "remindal/internal/database"
+	"remindal/internal/totp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Name the accounts are listed under in authenticator apps
+const TOTP_ISSUER = "Remindal"
+
+// Number of recovery codes generated when two-factor authentication is enabled
+const RECOVERY_CODES = 10
+
+var (
+	errTOTPRequired       = errors.New("two-factor authentication code required")
+	errInvalidCode        = errors.New("invalid or already used code")
+	errTOTPAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	errTOTPNotEnabled     = errors.New("two-factor authentication is not enabled")
+	errTOTPNotPending     = errors.New("two-factor authentication setup not started")
+)
+
+// Update removing every two-factor authentication field of a user
+var unsetTOTP = bson.D{{Key: "$unset", Value: bson.D{
+	{Key: "totpEnabled", Value: ""},
+	{Key: "totpSecret", Value: ""},
+	{Key: "totpPending", Value: ""},
+	{Key: "totpLastStep", Value: ""},
+	{Key: "recoveryCodes", Value: ""},
+}}}
+
+// Returns new random recovery codes, formatted to be read by users, along with
+// the hashes they are stored by
+func newRecoveryCodes() ([]string, []string, error) {
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, 0, RECOVERY_CODES)
+	hashes := make([]string, 0, RECOVERY_CODES)
+	for i := 0; i < RECOVERY_CODES; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		c := strings.ToLower(enc.EncodeToString(b))[:10]
+		codes = append(codes, c[:5]+"-"+c[5:])
+		hashes = append(hashes, hashToken(c))
+	}
+	return codes, hashes, nil
+}
+
+// Returns the recovery code as it is hashed, regardless of how it was typed
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// Checks the code of the authenticator app or the recovery code of the user, consuming
+// it so that it cannot be used again. Both are consumed atomically, so that concurrent
+// logins with the same code cannot both succeed.
+func verifySecondFactor(ctx context.Context, user User, code string) (bool, error) {
+	if step, ok := totp.Validate(user.TOTPSecret, code, time.Now()); ok {
+		query := bson.D{
+			{Key: EMAIL_KEY, Value: user.Email},
+			{Key: "totpLastStep", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$gte", Value: step}}}}},
+		}
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: "totpLastStep", Value: step}}}}
+		err := db.UpdateOneMatching(ctx, db.USER_COLLECTION, query, update)
+		if errors.Is(err, db.ErrNotFound) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	hash := hashToken(normalizeRecoveryCode(code))
+	query := bson.D{{Key: EMAIL_KEY, Value: user.Email}, {Key: "recoveryCodes", Value: hash}}
+	update := bson.D{{Key: "$pull", Value: bson.D{{Key: "recoveryCodes", Value: hash}}}}
+	err := db.UpdateOneMatching(ctx, db.USER_COLLECTION, query, update)
+	if errors.Is(err, db.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Reads the code of the request body into dest, responding with 400 if it is missing.
+// Returns whether the request can go on.
+func readCode(w http.ResponseWriter, r *http.Request, handler string, dest *TOTPCode) bool {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger(r).Error(handler+" - io.ReadAll", "err", err)
+		Eres(w, Err500(err))
+		return false
+	}
+	if err := json.Unmarshal(body, dest); err != nil {
+		Eres(w, Err400(err))
+		return false
+	}
+	if err := validate.Struct(dest); err != nil {
+		Eres(w, Err400(localize(err, r)))
+		return false
+	}
+	return true
+}
+
+// Handles requests to start enrolling an authenticator app.
+//
+// Generates a new secret for the logged in user and writes it along with its otpauth
+// URI, to be shown as a QR code, as a JSON response. Two-factor authentication is only
+// enabled once a first code is confirmed. If an error occurs, it responds with the
+// appropriate error message and status code.
+func SetupTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	p := principalOf(r)
+	var user User
+	if err := db.GetOne(r.Context(), db.USER_COLLECTION, EMAIL_KEY, p.Email, &user); err != nil {
+		logger(r).Error("SetupTOTPHandler - db.GetOne", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	if user.TOTPEnabled {
+		Eres(w, Err409(errTOTPAlreadyEnabled))
+		return
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		logger(r).Error("SetupTOTPHandler - totp.NewSecret", "err", err)
+		Eres(w, Err500(err))
+		return
+	}
+	err = db.UpdateOne(r.Context(), db.USER_COLLECTION, EMAIL_KEY, user.Email, bson.D{{Key: "totpPending", Value: secret}})
+	if err != nil {
+		logger(r).Error("SetupTOTPHandler - db.UpdateOne", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	Okres(w, TOTPSetup{Secret: secret, URI: totp.URI(TOTP_ISSUER, user.Email, secret)})
+}
+
+// Handles requests to confirm the enrollment of an authenticator app.
+//
+// Reads a first code of the app from the request body and, if it matches the secret
+// being enrolled, enables two-factor authentication. Writes the recovery codes as a
+// JSON response, they are only shown this once. If an error occurs, it responds with
+// the appropriate error message and status code.
+func ConfirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var req TOTPCode
+	if !readCode(w, r, "ConfirmTOTPHandler", &req) {
+		return
+	}
+
+	p := principalOf(r)
+	var user User
+	if err := db.GetOne(r.Context(), db.USER_COLLECTION, EMAIL_KEY, p.Email, &user); err != nil {
+		logger(r).Error("ConfirmTOTPHandler - db.GetOne", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	if user.TOTPPending == "" {
+		Eres(w, Err400(errTOTPNotPending))
+		return
+	}
+	step, ok := totp.Validate(user.TOTPPending, req.Code, time.Now())
+	if !ok {
+		Eres(w, Err400(errInvalidCode))
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		logger(r).Error("ConfirmTOTPHandler - newRecoveryCodes", "err", err)
+		Eres(w, Err500(err))
+		return
+	}
+	// only applies if the setup was not started again in the meantime
+	query := bson.D{{Key: EMAIL_KEY, Value: user.Email}, {Key: "totpPending", Value: user.TOTPPending}}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "totpEnabled", Value: true},
+			{Key: "totpSecret", Value: user.TOTPPending},
+			{Key: "totpLastStep", Value: step},
+			{Key: "recoveryCodes", Value: hashes},
+		}},
+		{Key: "$unset", Value: bson.D{{Key: "totpPending", Value: ""}}},
+	}
+	err = db.UpdateOneMatching(r.Context(), db.USER_COLLECTION, query, update)
+	if errors.Is(err, db.ErrNotFound) {
+		Eres(w, Err400(errTOTPNotPending))
+		return
+	}
+	if err != nil {
+		logger(r).Error("ConfirmTOTPHandler - db.UpdateOneMatching", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	Okres(w, codes)
+}
+
+// Handles requests to disable two-factor authentication.
+//
+// Reads a code of the authenticator app, or a recovery code, from the request body and,
+// if it is valid, disables two-factor authentication for the logged in user. If an error
+// occurs, it responds with the appropriate error message and status code.
+func DisableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var req TOTPCode
+	if !readCode(w, r, "DisableTOTPHandler", &req) {
+		return
+	}
+
+	p := principalOf(r)
+	var user User
+	if err := db.GetOne(r.Context(), db.USER_COLLECTION, EMAIL_KEY, p.Email, &user); err != nil {
+		logger(r).Error("DisableTOTPHandler - db.GetOne", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	if !user.TOTPEnabled {
+		Eres(w, Err400(errTOTPNotEnabled))
+		return
+	}
+	ok, err := verifySecondFactor(r.Context(), user, req.Code)
+	if err != nil {
+		logger(r).Error("DisableTOTPHandler - verifySecondFactor", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	if !ok {
+		Eres(w, Err403(errInvalidCode))
+		return
+	}
+
+	query := bson.D{{Key: EMAIL_KEY, Value: user.Email}}
+	if err := db.UpdateOneMatching(r.Context(), db.USER_COLLECTION, query, unsetTOTP); err != nil {
+		logger(r).Error("DisableTOTPHandler - db.UpdateOneMatching", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	Okres(w, nil)
+}
+
+// Handles requests of admins to reset the two-factor authentication of a user who
+// lost both the authenticator app and the recovery codes.
+//
+// Retrieves the email from the query parameters, disables two-factor authentication
+// for that user and ends every session of the user. If an error occurs, it responds
+// with the appropriate error message and status code.
+func ResetTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	userEmail := normalizeEmail(r.URL.Query().Get(EMAIL_KEY))
+	if userEmail == "" {
+		Eres(w, Err400(errNoEmailProvided))
+		return
+	}
+
+	query := bson.D{{Key: EMAIL_KEY, Value: userEmail}}
+	if err := db.UpdateOneMatching(r.Context(), db.USER_COLLECTION, query, unsetTOTP); err != nil {
+		logger(r).Error("ResetTOTPHandler - db.UpdateOneMatching", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	if err := revokeSessions(r.Context(), userEmail); err != nil {
+		logger(r).Error("ResetTOTPHandler - revokeSessions", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	logger(r).Info("two-factor authentication reset", "user", userEmail, "by", principalOf(r).Email)
+	Okres(w, nil)
+}
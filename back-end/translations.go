@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/go-playground/locales/en"
+	"github.com/go-playground/locales/it"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+	it_translations "github.com/go-playground/validator/v10/translations/it"
+	"golang.org/x/text/language"
+)
+
+// Translator of the languages the validation messages are available in, english is the fallback
+var uni = ut.New(en.New(), en.New(), it.New())
+
+// Messages of the custom validation rules, by language. {0} is the name of the field.
+var customMessages = map[string]map[string]string{
+	"day_validation": {
+		"en": "{0} is not a valid day for the given month and year",
+		"it": "{0} non è un giorno valido per il mese e l'anno indicati",
+	},
+	"password_policy": {
+		"en": "{0} must be at least 8 characters long and at most 72 bytes",
+		"it": "{0} deve essere lungo almeno 8 caratteri e al massimo 72 byte",
+	},
+	"birth_date": {
+		"en": "{0} must be a past date formatted as YYYY-MM-DD, at most 150 years ago",
+		"it": "{0} deve essere una data passata nel formato AAAA-MM-GG, al massimo 150 anni fa",
+	},
+}
+
+// A field that failed validation and the rule it broke
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
+
+// Validation failure with the messages translated in the language of the client
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (ve *ValidationError) Error() string {
+	msgs := make([]string, 0, len(ve.Fields))
+	for _, f := range ve.Fields {
+		msgs = append(msgs, f.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Registers the default messages of the built-in validation rules for every supported language
+func registerDefaultTranslations(validate *validator.Validate) {
+	trans, _ := uni.GetTranslator("en")
+	if err := en_translations.RegisterDefaultTranslations(validate, trans); err != nil {
+		slog.Error("registerDefaultTranslations - en_translations.RegisterDefaultTranslations", "err", err)
+	}
+	trans, _ = uni.GetTranslator("it")
+	if err := it_translations.RegisterDefaultTranslations(validate, trans); err != nil {
+		slog.Error("registerDefaultTranslations - it_translations.RegisterDefaultTranslations", "err", err)
+	}
+}
+
+// Registers the messages of a custom validation rule for every language they are available in
+func registerCustomTranslation(validate *validator.Validate, tag string) {
+	for lang, msg := range customMessages[tag] {
+		trans, _ := uni.GetTranslator(lang)
+		msg := msg
+		err := validate.RegisterTranslation(tag, trans,
+			func(t ut.Translator) error {
+				return t.Add(tag, msg, true)
+			},
+			func(t ut.Translator, fe validator.FieldError) string {
+				s, err := t.T(tag, fe.Field())
+				if err != nil {
+					return fe.Error()
+				}
+				return s
+			},
+		)
+		if err != nil {
+			slog.Error("registerCustomTranslation - validate.RegisterTranslation", "err", err)
+		}
+	}
+}
+
+// Returns the translator of the language the client prefers among the ones in
+// the Accept-Language header, english if none of them is supported
+func translatorFor(r *http.Request) ut.Translator {
+	tags, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	langs := make([]string, 0, len(tags))
+	for _, t := range tags {
+		base, _ := t.Base()
+		langs = append(langs, base.String())
+	}
+	trans, _ := uni.FindTranslator(langs...)
+	return trans
+}
+
+// Translates every field that failed validation with the given translator
+func translateFields(ve validator.ValidationErrors, trans ut.Translator) []FieldError {
+	fields := make([]FieldError, 0, len(ve))
+	for _, fe := range ve {
+		fields = append(fields, FieldError{
+			Field:   fe.Field(),
+			Rule:    fe.Tag(),
+			Param:   fe.Param(),
+			Message: fe.Translate(trans),
+		})
+	}
+	return fields
+}
+
+// Translates the validation errors inside err in the language of the client.
+// Any other error is returned untouched.
+func localize(err error, r *http.Request) error {
+	var ve validator.ValidationErrors
+	if !errors.As(err, &ve) {
+		return err
+	}
+	return &ValidationError{Fields: translateFields(ve, translatorFor(r))}
+}
+
+// Collects the fields that failed validation inside err, if any. Errors that were
+// not localized are reported in english.
+func fieldErrors(err error) []FieldError {
+	var le *ValidationError
+	if errors.As(err, &le) {
+		return le.Fields
+	}
+	var ve validator.ValidationErrors
+	if !errors.As(err, &ve) {
+		return nil
+	}
+	trans, _ := uni.GetTranslator("en")
+	return translateFields(ve, trans)
+}
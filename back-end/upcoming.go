@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	DEFAULT_WITHIN = 30 * 24 * time.Hour
+	MAX_WITHIN     = 5 * 366 * 24 * time.Hour
+
+	DEFAULT_LIMIT = 20
+	MAX_LIMIT     = 100
+)
+
+// Types of the dates that repeat every year, compared case insensitively.
+// Their next anniversary is upcoming even if the stored year is in the past.
+var yearlyTypes = []string{"birthday", "anniversary"}
+
+// Next occurrence of a date after a given point in time
+type Occurrence struct {
+	Date Date      `json:"date"`
+	At   time.Time `json:"at"`
+	// seconds from the request time to the occurrence
+	StartsIn int64 `json:"startsIn"`
+	// years since the stored date, only for the yearly types
+	Years int `json:"years,omitempty"`
+}
+
+func isYearly(dateType string) bool {
+	for _, t := range yearlyTypes {
+		if strings.EqualFold(t, dateType) {
+			return true
+		}
+	}
+	return false
+}
+
+var errWithinRange = errors.New("duration out of range")
+
+// Parses a duration that, besides the units accepted by [time.ParseDuration],
+// can be expressed in days or weeks, e.g. "30d" or "2w". Days and weeks beyond
+// MAX_WITHIN are rejected before they can overflow.
+func parseWithin(s string) (time.Duration, error) {
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(s, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(s, "w"):
+		unit = 7 * 24 * time.Hour
+	default:
+		return time.ParseDuration(s)
+	}
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n > int(MAX_WITHIN/unit) {
+		return 0, errWithinRange
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// Reads the within and limit parameters from the HTTP URL query, falling back to
+// the defaults when missing. Every invalid value is reported as a [ParamError].
+func parseUpcomingParams(q url.Values) (time.Duration, int, error) {
+	var (
+		within = DEFAULT_WITHIN
+		limit  = DEFAULT_LIMIT
+		err    error
+	)
+
+	if v := q.Get(WITHIN); hasValue(v) {
+		d, perr := parseWithin(v)
+		if perr != nil || d <= 0 || d > MAX_WITHIN {
+			reason := fmt.Sprintf("must be a positive duration up to %dd, e.g. 30d, 2w or 12h", MAX_WITHIN/(24*time.Hour))
+			err = errors.Join(err, &ParamError{Param: WITHIN, Reason: reason})
+		}
+		within = d
+	}
+
+	if v := q.Get(LIMIT); hasValue(v) {
+		n, perr := strconv.Atoi(v)
+		if perr != nil || n < 1 || n > MAX_LIMIT {
+			reason := fmt.Sprintf("must be an integer between 1 and %d", MAX_LIMIT)
+			err = errors.Join(err, &ParamError{Param: LIMIT, Reason: reason})
+		}
+		limit = n
+	}
+	return within, limit, err
+}
+
+// Builds the filter matching the dates that may occur between start and end: the yearly
+// ones regardless of their year, the others only if their year is in the window.
+// The exact point in time is checked when computing the occurrences.
+func occurrenceWindow(start, end time.Time) bson.D {
+	yearly := bson.D{{Key: "$regex", Value: "^(" + strings.Join(yearlyTypes, "|") + ")$"}, {Key: "$options", Value: "i"}}
+	return bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: DATE_TYPE, Value: yearly}},
+		bson.D{{Key: YEAR, Value: bson.D{{Key: "$gte", Value: start.Year()}, {Key: "$lte", Value: end.Year()}}}},
+	}}}
+}
+
+// Returns the point in time of the date in the given year. A 29th of February
+// falls on the 28th in the years that are not leap.
+func dateInYear(d Date, year int) time.Time {
+	day := int(d.Day)
+	if d.Month == 2 && day == 29 && time.Date(year, 3, 0, 0, 0, 0, 0, time.UTC).Day() != 29 {
+		day = 28
+	}
+	return time.Date(year, time.Month(d.Month), day, int(d.Hours), int(d.Minutes), 0, 0, time.UTC)
+}
+
+// Computes the first occurrence of the date not before now. Yearly types occur
+// every year from the stored one onwards, the other dates only once.
+// Returns false if the date has no occurrence left.
+func nextOccurrence(d Date, now time.Time) (Occurrence, bool) {
+	at := dateInYear(d, int(d.Year))
+	years := 0
+	if at.Before(now) {
+		if !isYearly(d.Type) {
+			return Occurrence{}, false
+		}
+		years = now.Year() - int(d.Year)
+		at = dateInYear(d, now.Year())
+		if at.Before(now) {
+			years++
+			at = dateInYear(d, now.Year()+1)
+		}
+	}
+	o := Occurrence{
+		Date:     d,
+		At:       at,
+		StartsIn: int64(at.Sub(now) / time.Second),
+		Years:    years,
+	}
+	return o, true
+}
+
+// Computes the occurrences of the dates between now and end, chronologically,
+// keeping at most limit of them
+func upcomingOccurrences(dates []Date, now, end time.Time, limit int) []Occurrence {
+	occ := []Occurrence{}
+	for _, d := range dates {
+		o, ok := nextOccurrence(d, now)
+		if !ok || o.At.After(end) {
+			continue
+		}
+		occ = append(occ, o)
+	}
+	sort.SliceStable(occ, func(i, j int) bool {
+		return occ[i].At.Before(occ[j].At)
+	})
+	if len(occ) > limit {
+		occ = occ[:limit]
+	}
+	return occ
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseWithin(t *testing.T) {
+	for in, want := range map[string]time.Duration{
+		"12h":  12 * time.Hour,
+		"30d":  30 * 24 * time.Hour,
+		"2w":   14 * 24 * time.Hour,
+		"1830": 0,
+	} {
+		got, err := parseWithin(in)
+		if want == 0 {
+			if err == nil {
+				t.Errorf("parseWithin(%q) = %v, want an error", in, got)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("parseWithin(%q) = %v, %v, want %v", in, got, err, want)
+		}
+	}
+	// would overflow, or wrap around to a valid duration, once multiplied
+	for _, in := range []string{"1831d", "262w", "106751992d", "15250285w", "-106751992d", "-15250285w"} {
+		if d, err := parseWithin(in); !errors.Is(err, errWithinRange) {
+			t.Errorf("parseWithin(%q) = %v, %v, want %v", in, d, err, errWithinRange)
+		}
+	}
+}
+
+func TestParseUpcomingParams(t *testing.T) {
+	within, limit, err := parseUpcomingParams(url.Values{})
+	if err != nil || within != DEFAULT_WITHIN || limit != DEFAULT_LIMIT {
+		t.Errorf("defaults = %v, %d, %v", within, limit, err)
+	}
+	within, limit, err = parseUpcomingParams(url.Values{WITHIN: {"2w"}, LIMIT: {"5"}})
+	if err != nil || within != 14*24*time.Hour || limit != 5 {
+		t.Errorf("parsed = %v, %d, %v", within, limit, err)
+	}
+
+	_, _, err = parseUpcomingParams(url.Values{WITHIN: {"9999999999999d"}, LIMIT: {"101"}})
+	params := map[string]bool{}
+	for _, pe := range paramErrors(err) {
+		params[pe.Param] = true
+	}
+	if !params[WITHIN] || !params[LIMIT] {
+		t.Errorf("errors = %v, want both parameters reported", err)
+	}
+}
+
+func TestNextOccurrence(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		date  Date
+		at    string
+		years int
+		ok    bool
+	}{
+		{"future date", Date{Type: "meeting", Year: 2025, Month: 3, Day: 2, Hours: 9}, "2025-03-02T09:00:00Z", 0, true},
+		{"past date", Date{Type: "meeting", Year: 2025, Month: 2, Day: 2}, "", 0, false},
+		{"birthday later this year", Date{Type: "Birthday", Year: 1990, Month: 6, Day: 15}, "2025-06-15T00:00:00Z", 35, true},
+		{"birthday already past", Date{Type: "birthday", Year: 1990, Month: 1, Day: 15}, "2026-01-15T00:00:00Z", 36, true},
+		{"leap day birthday", Date{Type: "birthday", Year: 2000, Month: 2, Day: 29}, "2026-02-28T00:00:00Z", 26, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, ok := nextOccurrence(tt.date, now)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if got := o.At.Format(time.RFC3339); got != tt.at || o.Years != tt.years {
+				t.Errorf("occurrence at %s after %d years, want %s after %d", got, o.Years, tt.at, tt.years)
+			}
+			if o.StartsIn != int64(o.At.Sub(now)/time.Second) {
+				t.Errorf("starts in %d seconds", o.StartsIn)
+			}
+		})
+	}
+}
+
+func TestUpcomingOccurrences(t *testing.T) {
+	now := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	dates := []Date{
+		{Desc: "c", Type: "meeting", Year: 2025, Month: 3, Day: 20},
+		{Desc: "a", Type: "birthday", Year: 1990, Month: 3, Day: 5},
+		{Desc: "out of the window", Type: "meeting", Year: 2025, Month: 5, Day: 1},
+		{Desc: "b", Type: "meeting", Year: 2025, Month: 3, Day: 10},
+	}
+	occ := upcomingOccurrences(dates, now, now.Add(30*24*time.Hour), 2)
+	if len(occ) != 2 || occ[0].Date.Desc != "a" || occ[1].Date.Desc != "b" {
+		t.Errorf("unexpected occurrences %+v", occ)
+	}
+}
@@ -4,15 +4,17 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
-	"log"
 	"net/http"
 	db "remindal/internal/database"
+	"time"
 
-	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var EMAIL_KEY = "_id"
 var errNoEmailProvided = errors.New("no email provided")
+var errNotLoggedIn = errors.New("not logged in with a session")
 
 // Handles requests to retrieve a list of users based on query parameters.
 //
@@ -33,12 +35,15 @@ func GetUsersListHandler(w http.ResponseWriter, r *http.Request) {
 
 	retrievedUserList := []User{}
 	sort := db.CreateSort("age", 1)
-	err = db.GetMany(db.USER_COLLECTION, qbuilder.Query(), sort, &retrievedUserList)
+	err = db.GetMany(r.Context(), db.USER_COLLECTION, qbuilder.Query(), sort, &retrievedUserList)
 	if err != nil {
-		log.Println("GetUserListHandler - db.GetMany ", err)
-		Eres(w, Err500(err))
+		logger(r).Error("GetUserListHandler - db.GetMany", "err", err)
+		Eres(w, ErrFrom(err))
 		return
 	}
+	for i, u := range retrievedUserList {
+		retrievedUserList[i] = u.Public()
+	}
 	Okres(w, retrievedUserList)
 }
 
@@ -48,71 +53,251 @@ func GetUsersListHandler(w http.ResponseWriter, r *http.Request) {
 // and writes the result as a JSON response. If an error occurs, it responds with
 // the appropriate error message and status code.
 func GetUserHandler(w http.ResponseWriter, r *http.Request) {
-	userEmail := r.URL.Query().Get(EMAIL_KEY)
+	userEmail := normalizeEmail(r.URL.Query().Get(EMAIL_KEY))
 	if userEmail == "" {
 		Eres(w, Err400(errNoEmailProvided))
 		return
 	}
 
 	var retrievedUser User
-	err := db.GetOne(db.USER_COLLECTION, EMAIL_KEY, userEmail, &retrievedUser)
+	err := db.GetOne(r.Context(), db.USER_COLLECTION, EMAIL_KEY, userEmail, &retrievedUser)
 	if err != nil {
-		Eres(w, Err400(err))
+		Eres(w, ErrFrom(err))
 		return
 	}
-	Okres(w, retrievedUser)
+	Okres(w, retrievedUser.Public())
 }
 
 // Handles requests to add a new user to the database.
 //
 // Reads the request body, unmarshals the JSON into a User, and inserts the user
-// into the database. If an error occurs, it responds with the appropriate error
-// message and status code.
+// into the database with the password hashed. The role can only be chosen by admins.
+// The user is created unverified and a link confirming the email is sent to it. If an
+// error occurs, it responds with the appropriate error message and status code.
 func PutUserHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Println("PutUserHandler - io.ReadAll ", err)
+		logger(r).Error("PutUserHandler - io.ReadAll", "err", err)
 		Eres(w, Err500(err))
 		return
 	}
 
 	var newuser User
 	if err := json.Unmarshal(body, &newuser); err != nil {
-		log.Println("PutUserHandler - json.Unmarshal ", err)
-		Eres(w, Err500(err))
+		Eres(w, Err400(err))
 		return
 	}
 
-	validate := validator.New()
+	newuser.Email = normalizeEmail(newuser.Email)
 	err = validate.Struct(newuser)
 	if err != nil {
-		Eres(w, Err400(err))
+		Eres(w, Err400(localize(err, r)))
 		return
 	}
 
-	if err := db.PutOne(db.USER_COLLECTION, newuser); err != nil {
-		log.Println("PutUserHandler - db.PutOne ", err)
+	// once password login is disabled, users sign up with single sign-on instead
+	admin := principalOf(r).IsAdmin()
+	if !admin {
+		allowed, err := passwordLoginAllowed(r.Context(), ROLE_USER)
+		if err != nil {
+			logger(r).Error("PutUserHandler - passwordLoginAllowed", "err", err)
+			Eres(w, ErrFrom(err))
+			return
+		}
+		if !allowed {
+			Eres(w, Err403(errPasswordLoginDisabled))
+			return
+		}
+	}
+
+	// only admins choose the role, anyone else signs up as a plain user
+	if !admin || newuser.Role == "" {
+		newuser.Role = ROLE_USER
+	}
+	newuser.Password, err = hashPassword(newuser.Password)
+	if err != nil {
+		logger(r).Error("PutUserHandler - hashPassword", "err", err)
 		Eres(w, Err500(err))
 		return
 	}
+	if birth, err := time.Parse(DATE_LAYOUT, newuser.BirthDate); err == nil {
+		newuser.Age = ageOn(birth, time.Now())
+	}
+	newuser.Unverified = true
+	newuser.DeleteAt = nil
+	newuser.CreatedAt = time.Now().UTC()
+
+	if err := db.PutOne(r.Context(), db.USER_COLLECTION, newuser); err != nil {
+		logger(r).Error("PutUserHandler - db.PutOne", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	// the user is created regardless, the link can be sent again
+	if err := sendVerification(r, newuser.Email); err != nil {
+		logger(r).Error("PutUserHandler - sendVerification", "err", err)
+	}
 	Okres(w, nil)
 }
 
-// Handles requests to delete a user from the database based on their email.
+// Handles requests to delete a user based on their email.
 //
-// Retrieves the email from the query parameters and deletes the user from the database.
+// Retrieves the email from the query parameters and schedules the deletion of the user
+// after the grace period, logging the user out everywhere. Logging in again before then
+// restores the account. Writes when the account will be deleted as a JSON response.
 // If an error occurs, it responds with the appropriate error message and status code.
 func DelUserHandler(w http.ResponseWriter, r *http.Request) {
-	userEmail := r.URL.Query().Get(EMAIL_KEY)
+	userEmail := normalizeEmail(r.URL.Query().Get(EMAIL_KEY))
 	if userEmail == "" {
 		Eres(w, Err400(errNoEmailProvided))
 		return
 	}
 
-	err := db.DeleteOne(db.USER_COLLECTION, EMAIL_KEY, userEmail)
+	deleteAt, err := scheduleDeletion(r, userEmail)
+	if errors.Is(err, errDeletionNotScheduled) {
+		Eres(w, Err409(err))
+		return
+	}
+	if err != nil {
+		logger(r).Error("DelUserHandler - scheduleDeletion", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	Okres(w, DeletionSchedule{DeleteAt: deleteAt})
+}
+
+// Handles requests to log in with an email and a password.
+//
+// Reads the credentials from the request body and, if they match, creates a session
+// and writes its token along with its expiration as a JSON response. The token must be
+// sent in the Authorization header as a bearer token. The account is locked after too
+// many failed attempts. Unknown emails and wrong passwords are told apart neither by
+// the response nor by its timing. Users with two-factor authentication enabled must
+// also send a code of their authenticator app or a recovery code, the response tells
+// when it is missing once the password matches.
+func LoginHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
+		logger(r).Error("LoginHandler - io.ReadAll", "err", err)
+		Eres(w, Err500(err))
+		return
+	}
+
+	var creds Credentials
+	if err := json.Unmarshal(body, &creds); err != nil {
 		Eres(w, Err400(err))
 		return
 	}
+	creds.Email = normalizeEmail(creds.Email)
+	if err := validate.Struct(creds); err != nil {
+		Eres(w, Err400(localize(err, r)))
+		return
+	}
+
+	account := creds.Email
+	if !checkLockout(w, r, account) {
+		return
+	}
+
+	var user User
+	err = db.GetOne(r.Context(), db.USER_COLLECTION, EMAIL_KEY, creds.Email, &user)
+	if errors.Is(err, db.ErrNotFound) {
+		// as much work as checking a real password
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(creds.Password))
+		recordLogin(r, account, false)
+		Eres(w, Err401(errInvalidCredentials))
+		return
+	}
+	if err != nil {
+		logger(r).Error("LoginHandler - db.GetOne", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+
+	ok, rehash := checkPassword(user.Password, creds.Password)
+	if !ok {
+		recordLogin(r, account, false)
+		Eres(w, Err401(errInvalidCredentials))
+		return
+	}
+	allowed, err := passwordLoginAllowed(r.Context(), user.Role)
+	if err != nil {
+		logger(r).Error("LoginHandler - passwordLoginAllowed", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	if !allowed {
+		Eres(w, Err403(errPasswordLoginDisabled))
+		return
+	}
+	if user.TOTPEnabled {
+		if creds.Code == "" {
+			Eres(w, Err401(errTOTPRequired))
+			return
+		}
+		ok, err := verifySecondFactor(r.Context(), user, creds.Code)
+		if err != nil {
+			logger(r).Error("LoginHandler - verifySecondFactor", "err", err)
+			Eres(w, ErrFrom(err))
+			return
+		}
+		if !ok {
+			recordLogin(r, account, false)
+			Eres(w, Err401(errInvalidCode))
+			return
+		}
+	}
+	recordLogin(r, account, true)
+	if user.DeleteAt != nil {
+		err := restoreAccount(r.Context(), user.Email, AUDIT_SELF)
+		if errors.Is(err, errAccountPurging) {
+			Eres(w, Err403(err))
+			return
+		}
+		if err != nil && !errors.Is(err, errDeletionNotScheduled) {
+			logger(r).Error("LoginHandler - restoreAccount", "err", err)
+			Eres(w, ErrFrom(err))
+			return
+		}
+	}
+	if rehash {
+		upgradePassword(r, user.Email, creds.Password)
+	}
+
+	session, err := newSession(r.Context(), user.Email)
+	if err != nil {
+		logger(r).Error("LoginHandler - newSession", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	Okres(w, session)
+}
+
+// Replaces a password stored in plain text with its hash. Failures are only logged,
+// the password is upgraded at the next login.
+func upgradePassword(r *http.Request, email, password string) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		logger(r).Error("upgradePassword - hashPassword", "err", err)
+		return
+	}
+	err = db.UpdateOne(r.Context(), db.USER_COLLECTION, EMAIL_KEY, email, bson.D{{Key: "password", Value: hash}})
+	if err != nil {
+		logger(r).Error("upgradePassword - db.UpdateOne", "err", err)
+	}
+}
+
+// Handles requests to log out, ending the session the request is authenticated with.
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	p := principalOf(r)
+	if p == nil || p.session == "" {
+		Eres(w, Err400(errNotLoggedIn))
+		return
+	}
+	err := db.DeleteOne(r.Context(), db.SESSION_COLLECTION, "_id", p.session)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		logger(r).Error("LogoutHandler - db.DeleteOne", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
 	Okres(w, nil)
 }
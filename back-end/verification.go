@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	db "remindal/internal/database"
+	"remindal/internal/mail"
+	"remindal/internal/ratelimit"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const TOKEN_VERIFY = "verify"
+
+// Key of the query parameter carrying a token sent by email
+const TOKEN_KEY = "token"
+
+var (
+	verifyTokenTTL    time.Duration
+	unverifiedTTL     time.Duration
+	verifyResendLimit = ratelimit.Limit{Count: 3, Period: time.Hour}
+)
+
+var (
+	errNoTokenProvided = errors.New("no token provided")
+	errUnverified      = errors.New("the email must be verified first")
+)
+
+// Issues a verification token for the user and sends the link confirming the email
+func sendVerification(r *http.Request, email string) error {
+	token, err := issueEmailToken(r.Context(), TOKEN_VERIFY, email, verifyTokenTTL)
+	if err != nil {
+		return err
+	}
+	sendEmail(r, mail.Message{
+		To:      email,
+		Subject: "Confirm your Remindal account",
+		Body: "Welcome to Remindal!\n\n" +
+			"Confirm your email by opening the link below:\n" +
+			link("/user/verify", url.Values{TOKEN_KEY: {token}}) + "\n\n" +
+			"The link expires in " + verifyTokenTTL.String() + ". If you did not sign up, ignore this email.\n",
+	})
+	return nil
+}
+
+// Handles requests to confirm the email of a new user.
+//
+// Reads the token sent by email from the query parameters and marks the user it was
+// issued to as verified. The token cannot be used again. If an error occurs, it
+// responds with the appropriate error message and status code.
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get(TOKEN_KEY)
+	if token == "" {
+		Eres(w, Err400(errNoTokenProvided))
+		return
+	}
+
+	t, err := consumeEmailToken(r.Context(), TOKEN_VERIFY, token)
+	if errors.Is(err, errInvalidEmailToken) {
+		Eres(w, Err400(err))
+		return
+	}
+	if err != nil {
+		logger(r).Error("VerifyEmailHandler - consumeEmailToken", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+
+	err = db.UpdateOne(r.Context(), db.USER_COLLECTION, EMAIL_KEY, t.User, bson.D{{Key: "unverified", Value: false}})
+	if errors.Is(err, db.ErrNotFound) {
+		// purged in the meantime
+		Eres(w, Err400(errInvalidEmailToken))
+		return
+	}
+	if err != nil {
+		logger(r).Error("VerifyEmailHandler - db.UpdateOne", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	Okres(w, nil)
+}
+
+// Handles requests to send the verification email again.
+//
+// Reads the email from the request body and, if it belongs to an unverified user,
+// sends a new verification link, revoking the previous ones. Responds the same way
+// whether the email is registered or not. Each email can only be sent a few links
+// per period.
+func ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger(r).Error("ResendVerificationHandler - io.ReadAll", "err", err)
+		Eres(w, Err500(err))
+		return
+	}
+
+	var req EmailRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		Eres(w, Err400(err))
+		return
+	}
+	req.Email = normalizeEmail(req.Email)
+	if err := validate.Struct(req); err != nil {
+		Eres(w, Err400(localize(err, r)))
+		return
+	}
+
+	wait, err := limiter.Allow(r.Context(), "verify-resend:"+req.Email, verifyResendLimit)
+	if err != nil {
+		logger(r).Error("ResendVerificationHandler - limiter.Allow", "err", err)
+	}
+	if wait > 0 {
+		Eres(w, Err429(errRateLimited, wait))
+		return
+	}
+
+	var user User
+	err = db.GetOne(r.Context(), db.USER_COLLECTION, EMAIL_KEY, req.Email, &user)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && !user.Unverified) {
+		Okres(w, nil)
+		return
+	}
+	if err != nil {
+		logger(r).Error("ResendVerificationHandler - db.GetOne", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+
+	if err := sendVerification(r, user.Email); err != nil {
+		logger(r).Error("ResendVerificationHandler - sendVerification", "err", err)
+		Eres(w, ErrFrom(err))
+		return
+	}
+	Okres(w, nil)
+}
+
+// Erases the users that did not verify their email within the allowed period, along
+// with every piece of data of theirs, every interval until the context is done
+func purgeUnverified(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var users []User
+			query := bson.D{
+				{Key: "unverified", Value: true},
+				{Key: "createdAt", Value: bson.D{{Key: "$lt", Value: time.Now().UTC().Add(-unverifiedTTL)}}},
+			}
+			if err := db.GetMany(ctx, db.USER_COLLECTION, query, db.CreateSort("createdAt", 1), &users); err != nil {
+				slog.Error("purgeUnverified - db.GetMany", "err", err)
+				continue
+			}
+			n := 0
+			for _, u := range users {
+				if err := purgeUser(ctx, u, query); err != nil {
+					slog.Error("purgeUnverified - purgeUser", "err", err)
+					continue
+				}
+				n++
+			}
+			if n > 0 {
+				slog.Info("purged unverified users", "count", n)
+			}
+		}
+	}
+}
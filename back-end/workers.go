@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+// Background jobs running alongside the server. They receive a context that is
+// done when the server shuts down, and are expected to return soon after.
+type workerGroup struct {
+	ctx     context.Context
+	stop    context.CancelFunc
+	wg      sync.WaitGroup
+	running atomic.Int32
+
+	mu    sync.Mutex
+	names map[string]int
+}
+
+var workers = newWorkerGroup()
+
+func newWorkerGroup() *workerGroup {
+	ctx, stop := context.WithCancel(context.Background())
+	return &workerGroup{ctx: ctx, stop: stop, names: map[string]int{}}
+}
+
+// Runs the job in its own goroutine until it returns or the group is stopped
+func (g *workerGroup) Go(name string, job func(ctx context.Context)) {
+	g.wg.Add(1)
+	g.running.Add(1)
+	g.mu.Lock()
+	g.names[name]++
+	g.mu.Unlock()
+	go func() {
+		defer g.wg.Done()
+		defer g.running.Add(-1)
+		defer func() {
+			g.mu.Lock()
+			g.names[name]--
+			g.mu.Unlock()
+		}()
+		job(g.ctx)
+		slog.Info("worker stopped", "worker", name)
+	}()
+}
+
+// Returns the number of jobs still running
+func (g *workerGroup) Running() int {
+	return int(g.running.Load())
+}
+
+// Reports whether at least one job with the given name is still running
+func (g *workerGroup) IsRunning(name string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.names[name] > 0
+}
+
+// Reports whether the group has been stopped
+func (g *workerGroup) Stopped() bool {
+	return g.ctx.Err() != nil
+}
+
+// Signals every job to stop and waits for them to return until the context is done
+func (g *workerGroup) Stop(ctx context.Context) error {
+	g.stop()
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}